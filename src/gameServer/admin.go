@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strings"
+)
+
+// The admin socket is a separate listener for operators, speaking one
+// command per line:
+//
+//	GAMES                 list the games with their state, leader, picker and player counts
+//	PLAYERS               list the connected players and the games they are in
+//	CLOSE_GAME <gameID>   close a game as if its leader had closed it
+//	KICK <player>         drop the connection of a player
+//	CORPORA               list the corpora of the library, see library.go
+//	REMOVE_CORPUS <name>  remove a corpus from the library, games using it keep it
+//	SHUTDOWN              shut down the game server gracefully
+//
+// Listings print one line per entry. Every command ends with a line that
+// is either "OK" or "ERROR <reason>".
+
+// adminSnapshot is what the server routine hands to an admin connection:
+// the live games and the connections of the players that are online.
+type adminSnapshot struct {
+	games map[string]*Game
+	conns map[string]net.Conn
+}
+
+// gameStatus is a snapshot of a game taken by its own routine
+type gameStatus struct {
+	gameID       string
+	state        GameState
+	leader       string
+	picker       string
+	round        int
+	players      []string
+	disconnected []string
+	spectators   []string
+}
+
+func (status gameStatus) String() string {
+	return fmt.Sprintf("%s state=%s leader=%s picker=%s round=%d players=%d disconnected=%d spectators=%d",
+		status.gameID, status.state, status.leader, status.picker, status.round,
+		len(status.players), len(status.disconnected), len(status.spectators))
+}
+
+// status is called by the game routine to answer an admin
+func (game *Game) status() gameStatus {
+	names := func(m map[string]chan map[string]string) []string {
+		list := make([]string, 0, len(m))
+		for name := range m {
+			list = append(list, name)
+		}
+		sort.Strings(list)
+		return list
+	}
+	return gameStatus{
+		gameID:       game.gameID,
+		state:        game.state,
+		leader:       game.leader,
+		picker:       game.picker,
+		round:        game.round,
+		players:      names(game.names),
+		disconnected: names(game.namesDisconn),
+		spectators:   names(game.spectators),
+	}
+}
+
+// ListenAdmin binds the admin socket and serves it until the server shuts
+// down. It must be called before Run. addr takes a single address in the
+// format of parseAddrs, e.g. "unix:/tmp/wordcount-admin.sock", and the
+// bound address is returned. Anyone who reaches the socket may shut the
+// server down, so TCP addresses must be on the loopback interface.
+func (server *GameServer) ListenAdmin(addr string) (net.Addr, error) {
+	addrs, err := parseAddrs(RunningProtocol, addr)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) != 1 {
+		return nil, errors.New("the admin socket takes a single address")
+	}
+	if !addrs[0].loopback() {
+		return nil, fmt.Errorf("the admin socket must be local, not %s", addrs[0].address)
+	}
+	listener, err := addrs[0].listen()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("admin socket listening on %s %s", listener.Addr().Network(), listener.Addr())
+	server.adminListener = listener
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				break
+			}
+			go adminRoutine(conn, server)
+		}
+	}()
+	return listener.Addr(), nil
+}
+
+// adminRoutine serves one admin connection
+func adminRoutine(conn net.Conn, server *GameServer) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		cmd := strings.Fields(scanner.Text())
+		if len(cmd) == 0 {
+			continue
+		}
+		switch cmd[0] {
+		case "GAMES":
+			snapshot, ok := server.adminSnapshot()
+			if !ok {
+				io.WriteString(conn, "ERROR shutting down\n")
+				continue
+			}
+			for _, status := range gameStatuses(snapshot) {
+				io.WriteString(conn, status.String()+"\n")
+			}
+			io.WriteString(conn, "OK\n")
+
+		case "PLAYERS":
+			snapshot, ok := server.adminSnapshot()
+			if !ok {
+				io.WriteString(conn, "ERROR shutting down\n")
+				continue
+			}
+			games := make(map[string][]string)
+			watching := make(map[string][]string)
+			for _, status := range gameStatuses(snapshot) {
+				for _, name := range status.players {
+					games[name] = append(games[name], status.gameID)
+				}
+				for _, name := range status.spectators {
+					watching[name] = append(watching[name], status.gameID)
+				}
+			}
+			names := make([]string, 0, len(snapshot.conns))
+			for name := range snapshot.conns {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				io.WriteString(conn, fmt.Sprintf("%s games=%s watching=%s\n",
+					name, strings.Join(games[name], ","), strings.Join(watching[name], ",")))
+			}
+			io.WriteString(conn, "OK\n")
+
+		case "CLOSE_GAME":
+			if len(cmd) != 2 {
+				io.WriteString(conn, "ERROR usage: CLOSE_GAME <gameID>\n")
+				continue
+			}
+			snapshot, ok := server.adminSnapshot()
+			if !ok {
+				io.WriteString(conn, "ERROR shutting down\n")
+				continue
+			}
+			game, ok := snapshot.games[cmd[1]]
+			if !ok {
+				io.WriteString(conn, fmt.Sprintf("ERROR no game %s\n", cmd[1]))
+				continue
+			}
+			select {
+			case game.chanAdminClose <- true:
+				io.WriteString(conn, "OK\n")
+			case <-game.done:
+				io.WriteString(conn, fmt.Sprintf("ERROR no game %s\n", cmd[1]))
+			}
+
+		case "KICK":
+			if len(cmd) != 2 {
+				io.WriteString(conn, "ERROR usage: KICK <player>\n")
+				continue
+			}
+			snapshot, ok := server.adminSnapshot()
+			if !ok {
+				io.WriteString(conn, "ERROR shutting down\n")
+				continue
+			}
+			target, ok := snapshot.conns[cmd[1]]
+			if !ok {
+				io.WriteString(conn, fmt.Sprintf("ERROR player %s is not connected\n", cmd[1]))
+				continue
+			}
+			// the player routine sees the connection drop and leaves as disconnected
+			target.Close()
+			io.WriteString(conn, "OK\n")
+
+		case "CORPORA":
+			library := server.libraryCall(libraryRequest{op: "list"})
+			for _, corpus := range library.corpora {
+				io.WriteString(conn, fmt.Sprintf("%s size=%d sha256=%s\n", corpus.Name, corpus.Size, corpus.Sha256))
+			}
+			io.WriteString(conn, "OK\n")
+
+		case "REMOVE_CORPUS":
+			if len(cmd) != 2 {
+				io.WriteString(conn, "ERROR usage: REMOVE_CORPUS <name>\n")
+				continue
+			}
+			if server.libraryCall(libraryRequest{op: "remove", name: cmd[1]}).reason != "" {
+				io.WriteString(conn, fmt.Sprintf("ERROR no corpus %s\n", cmd[1]))
+				continue
+			}
+			io.WriteString(conn, "OK\n")
+
+		case "SHUTDOWN":
+			// answered once the server stopped listening and the games exited
+			server.Close()
+			io.WriteString(conn, "OK\n")
+			return
+
+		default:
+			io.WriteString(conn, fmt.Sprintf("ERROR unknown command %s\n", cmd[0]))
+		}
+	}
+}
+
+// adminSnapshot asks the server routine for the games and connections,
+// false once the server routine stopped
+func (server *GameServer) adminSnapshot() (adminSnapshot, bool) {
+	select {
+	case server.chanAdminReq <- true:
+		return <-server.chanAdminResp, true
+	case <-server.stopping:
+		return adminSnapshot{}, false
+	}
+}
+
+// gameStatuses asks every game of a snapshot for its status, sorted by gameID
+func gameStatuses(snapshot adminSnapshot) []gameStatus {
+	statuses := make([]gameStatus, 0, len(snapshot.games))
+	reply := make(chan gameStatus)
+	for _, game := range snapshot.games {
+		select {
+		case game.chanStatus <- reply:
+			statuses = append(statuses, <-reply)
+		case <-game.done:
+			// the game ended after the snapshot was taken
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].gameID < statuses[j].gameID })
+	return statuses
+}
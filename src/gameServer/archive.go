@@ -0,0 +1,238 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// Uploads may be compressed or archived. unpackUpload looks at the first
+// bytes of a stored upload and
+//
+//	gzip   decompresses it, and extracts it further if it holds a tar
+//	zip    extracts its files
+//	tar    extracts its files
+//
+// Whatever comes out of an archive goes to a directory named after it,
+// e.g. corpus.tar.gz to corpus/, and only the text files are counted.
+// Any other upload is counted as text, as it always was.
+
+// extraction keeps track of an archive being unpacked into the game directory
+type extraction struct {
+	directory string   // the game directory
+	base      string   // where the files go, relative to the game directory
+	files     []string // text files extracted so far, relative to the game directory
+	budget    int64    // bytes that may still be extracted
+	members   int      // entries seen so far, files or not
+}
+
+// unpackUpload returns the files of an upload to count, relative to the
+// game directory, or the reason the upload is refused
+func unpackUpload(directory string, fileName string) ([]string, string) {
+	fd, err := os.Open(directory + fileName)
+	if err != nil {
+		return nil, "write failed"
+	}
+	defer fd.Close()
+	info, err := fd.Stat()
+	if err != nil {
+		return nil, "write failed"
+	}
+	reader := bufio.NewReader(fd)
+	head, _ := reader.Peek(512)
+	isGzip := bytes.HasPrefix(head, []byte{0x1f, 0x8b})
+	isZip := bytes.HasPrefix(head, []byte("PK\x03\x04")) || bytes.HasPrefix(head, []byte("PK\x05\x06"))
+	if !isGzip && !isZip && !isTar(head) {
+		return []string{fileName}, ""
+	}
+
+	base := archiveBase(fileName)
+	if _, err := os.Stat(directory + base); err == nil {
+		return nil, "file exists"
+	}
+	// a small archive may always expand to MAX_UPLOAD_SIZE, anything past
+	// that has to stay within MAX_ARCHIVE_RATIO of the archive
+	budget := int64(MAX_ARCHIVE_RATIO) * info.Size()
+	if budget < int64(MAX_UPLOAD_SIZE) {
+		budget = int64(MAX_UPLOAD_SIZE)
+	}
+	if budget > int64(MAX_CORPUS_SIZE) {
+		budget = int64(MAX_CORPUS_SIZE)
+	}
+	e := &extraction{directory: directory, base: base, files: make([]string, 0), budget: budget}
+
+	var reason string
+	switch {
+	case isGzip:
+		reason = e.gunzip(reader, fileName)
+	case isZip:
+		reason = e.unzip(fd, info.Size())
+	default:
+		reason = e.untar(reader)
+	}
+	if reason == "" && len(e.files) == 0 {
+		reason = "no text files"
+	}
+	if reason != "" {
+		os.RemoveAll(directory + base)
+		return nil, reason
+	}
+	return e.files, ""
+}
+
+// archiveBase names the directory an archive is extracted to
+func archiveBase(fileName string) string {
+	base := fileName
+	for _, ext := range []string{".gz", ".tgz", ".tar", ".zip", ".txt"} {
+		base = strings.TrimSuffix(base, ext)
+	}
+	if base == "" || base == fileName {
+		base = fileName + ".d"
+	}
+	return base
+}
+
+func isTar(head []byte) bool {
+	return len(head) >= 262 && string(head[257:262]) == "ustar"
+}
+
+// isText tells text from binary data by its first bytes: no NULs, and
+// valid UTF-8 up to a rune cut in half at the end
+func isText(head []byte) bool {
+	if bytes.IndexByte(head, 0) >= 0 {
+		return false
+	}
+	for i := 0; i < utf8.UTFMax-1 && !utf8.Valid(head); i++ {
+		head = head[:len(head)-1]
+	}
+	return utf8.Valid(head)
+}
+
+func (e *extraction) gunzip(reader io.Reader, fileName string) string {
+	gz, err := gzip.NewReader(reader)
+	if err != nil {
+		return "corrupt archive"
+	}
+	defer gz.Close()
+	inner := bufio.NewReader(gz)
+	head, _ := inner.Peek(512)
+	if isTar(head) {
+		return e.untar(inner)
+	}
+	if reason := e.member(); reason != "" {
+		return reason
+	}
+	// the name stored in the gzip header is not trusted
+	return e.add(strings.TrimSuffix(fileName, ".gz"), inner)
+}
+
+func (e *extraction) unzip(fd *os.File, size int64) string {
+	archive, err := zip.NewReader(fd, size)
+	if err != nil && !errors.Is(err, zip.ErrInsecurePath) {
+		return "corrupt archive"
+	}
+	for _, f := range archive.File {
+		if reason := e.member(); reason != "" {
+			return reason
+		}
+		if !f.Mode().IsRegular() {
+			// directories and symlinks
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return "corrupt archive"
+		}
+		reason := e.add(f.Name, rc)
+		rc.Close()
+		if reason != "" {
+			return reason
+		}
+	}
+	return ""
+}
+
+func (e *extraction) untar(reader io.Reader) string {
+	archive := tar.NewReader(reader)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return ""
+		}
+		if err != nil && !errors.Is(err, tar.ErrInsecurePath) {
+			return "corrupt archive"
+		}
+		if reason := e.member(); reason != "" {
+			return reason
+		}
+		if header.Typeflag != tar.TypeReg {
+			// directories, links and devices
+			continue
+		}
+		if reason := e.add(header.Name, archive); reason != "" {
+			return reason
+		}
+	}
+}
+
+// member counts an entry of the archive against MAX_ARCHIVE_FILES
+func (e *extraction) member() string {
+	e.members++
+	if e.members > MAX_ARCHIVE_FILES {
+		return "too many files"
+	}
+	return ""
+}
+
+// add extracts one file of the archive if it is text. Names that would
+// leave the extraction directory refuse the whole archive, hidden files
+// such as __MACOSX/._notes.txt are skipped.
+func (e *extraction) add(name string, r io.Reader) string {
+	clean := path.Clean(name)
+	if strings.ContainsAny(name, "\\,") || !filepath.IsLocal(filepath.FromSlash(clean)) {
+		return "unsafe path"
+	}
+	for _, part := range strings.Split(clean, "/") {
+		if strings.HasPrefix(part, ".") || part == "__MACOSX" {
+			return ""
+		}
+	}
+	reader := bufio.NewReaderSize(r, 8192)
+	head, err := reader.Peek(8192)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return "corrupt archive"
+	}
+	if !isText(head) {
+		return ""
+	}
+
+	target := e.directory + e.base + "/" + clean
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return "write failed"
+	}
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		// the same name twice, or a file where a directory should be
+		return "unsafe path"
+	}
+	n, err := io.CopyN(out, reader, e.budget+1)
+	out.Close()
+	if n > e.budget {
+		return "too large when extracted"
+	}
+	if err != nil && err != io.EOF {
+		return "corrupt archive"
+	}
+	e.budget -= n
+	e.files = append(e.files, e.base+"/"+clean)
+	return ""
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Names are claimed with a password. HELLO takes it as an option:
+//
+//	HELLO alice                  a guest, unless alice is registered
+//	HELLO alice password=secret  registers alice, or logs her in
+//	HELLO alice token=3f9c...    logs alice in with the token of her last login
+//
+// A name that has never been given a password is open to anyone, as it
+// always was. Once registered it needs the password or the resume token,
+// so nobody else gets its games and its leadership on HELLO or RECONN.
+// Every password login issues a new token, which replaces the one before.
+//
+// Passwords are kept as salted, iterated SHA-256 hashes and tokens as
+// plain SHA-256 hashes, in AccountsFileName in the storage directory. Only
+// the server routine touches the accounts. It hands out the salt of a name
+// and the client routine hashes the password, so a login does not hold up
+// everybody else.
+
+// AccountsFileName holds the registered names, the dot keeps it apart
+// from the game directories
+const AccountsFileName string = ".accounts.json"
+
+// account is a registered name
+type account struct {
+	Salt  string `json:"salt"`  // hex
+	Hash  string `json:"hash"`  // passwordHash of the password, hex
+	Token string `json:"token"` // sha256 of the resume token, hex
+}
+
+type accountStore struct {
+	path     string
+	Accounts map[string]account `json:"accounts"` // by name
+}
+
+// helloRequest asks the server routine for the player of a HELLO
+type helloRequest struct {
+	name     string
+	password string     // "" unless given, it does not go to the server routine
+	salt     string     // the salt of the name, see hashPassword
+	hash     string     // passwordHash of the password, "" unless given
+	token    string     // "" unless given
+	session  string     // the session token of a RESUME, the name is then unknown
+	pc       playerConn // the connection of the HELLO
+}
+
+// helloResponse is the player of a HELLO, or why it was refused
+type helloResponse struct {
+	player  *Player
+	token   string      // a new resume token after a password login
+	session string      // the token of the new session, see session.go
+	taken   *playerConn // the connection the player was online on, nil if none
+	reason  string      // "" on success
+}
+
+// openAccounts loads the accounts in a storage directory
+func openAccounts(storage string) *accountStore {
+	store := &accountStore{path: storage + AccountsFileName, Accounts: make(map[string]account)}
+	data, err := os.ReadFile(store.path)
+	if err == nil {
+		if err := json.Unmarshal(data, store); err != nil {
+			fmt.Printf("error: cannot read the accounts: %v\n", err)
+		}
+	}
+	return store
+}
+
+// save writes the accounts, through a temp file so a crash leaves the old ones
+func (store *accountStore) save() {
+	data, _ := json.Marshal(store)
+	temp := store.path + ".tmp"
+	if err := os.WriteFile(temp, data, 0600); err != nil {
+		fmt.Printf("error: cannot write the accounts: %v\n", err)
+		return
+	}
+	os.Rename(temp, store.path)
+}
+
+// parseHello reads the options of a HELLO after the name
+func parseHello(name string, options []string) (helloRequest, bool) {
+	req := helloRequest{name: name}
+	for _, option := range options {
+		key, value, ok := strings.Cut(option, "=")
+		switch {
+		case ok && key == "password" && value != "":
+			req.password = value
+		case ok && key == "token" && value != "":
+			req.token = value
+		default:
+			return req, false
+		}
+	}
+	return req, req.password == "" || req.token == ""
+}
+
+// authenticate checks the credentials of a HELLO. It returns a new resume
+// token after a password login, and the reason the HELLO is refused, ""
+// if it is not. online tells whether the name is connected right now.
+func (store *accountStore) authenticate(req helloRequest, online bool) (string, string) {
+	acc, registered := store.Accounts[req.name]
+	switch {
+	case !registered && req.token != "":
+		return "", "invalid token"
+	case !registered && req.hash == "":
+		// a guest
+		return "", ""
+	case !registered && online:
+		// somebody is playing under the name, it is not free to claim
+		return "", "name in use"
+	case !registered:
+		acc = account{Salt: req.salt, Hash: req.hash}
+	case req.token != "":
+		if !equalHex(acc.Token, tokenHash(req.token)) {
+			return "", "invalid token"
+		}
+		return "", ""
+	case req.hash == "":
+		return "", "authentication required"
+	case req.salt != acc.Salt || !equalHex(acc.Hash, req.hash):
+		// a salt that changed meanwhile, the name was registered in between
+		return "", "wrong password"
+	}
+	token := randomHex(16)
+	acc.Token = tokenHash(token)
+	store.Accounts[req.name] = acc
+	store.save()
+	return token, ""
+}
+
+// salt returns the salt of a registered name, or a new one to register it
+func (store *accountStore) salt(name string) string {
+	if acc, registered := store.Accounts[name]; registered {
+		return acc.Salt
+	}
+	return randomHex(16)
+}
+
+// hashPassword replaces the password of a HELLO by its hash, in the client
+// routine
+func (req *helloRequest) hashPassword(server *GameServer) {
+	if req.password == "" {
+		return
+	}
+	server.chanSaltReq <- req.name
+	req.salt = <-server.chanSaltResp
+	req.hash = passwordHash(req.salt, req.password)
+	req.password = ""
+}
+
+// passwordHash stretches a salted password with AUTH_ROUNDS rounds of SHA-256
+func passwordHash(salt string, password string) string {
+	sum := sha256.Sum256([]byte(salt + password))
+	for i := 1; i < AUTH_ROUNDS; i++ {
+		sum = sha256.Sum256(sum[:])
+	}
+	return hex.EncodeToString(sum[:])
+}
+
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func equalHex(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"html"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Documents are counted by the words a reader sees, not by their markup.
+// The format of a file comes from the "format" option of the upload, or
+// else from its extension:
+//
+//	text       .txt and anything else, counted as it is
+//	html       .html .htm, the text between the tags, without scripts and styles
+//	markdown   .md .markdown, the text without markup, links and code blocks
+//	csv        .csv, the fields of the columns chosen with "columns", or all of them
+//	json       .json .jsonl .ndjson, the string values, one document or a stream of them
+const (
+	FORMAT_TEXT     string = "text"
+	FORMAT_HTML     string = "html"
+	FORMAT_MARKDOWN string = "markdown"
+	FORMAT_CSV      string = "csv"
+	FORMAT_JSON     string = "json"
+)
+
+var formatExtensions = map[string]string{
+	".txt":      FORMAT_TEXT,
+	".html":     FORMAT_HTML,
+	".htm":      FORMAT_HTML,
+	".md":       FORMAT_MARKDOWN,
+	".markdown": FORMAT_MARKDOWN,
+	".csv":      FORMAT_CSV,
+	".json":     FORMAT_JSON,
+	".jsonl":    FORMAT_JSON,
+	".ndjson":   FORMAT_JSON,
+}
+
+func validFormat(format string) bool {
+	switch format {
+	case FORMAT_TEXT, FORMAT_HTML, FORMAT_MARKDOWN, FORMAT_CSV, FORMAT_JSON:
+		return true
+	}
+	return false
+}
+
+// documentFormat returns the format of a file, format is the one asked for
+// at upload or "" to go by the extension
+func documentFormat(path string, format string) string {
+	if format != "" {
+		return format
+	}
+	if format, ok := formatExtensions[strings.ToLower(filepath.Ext(path))]; ok {
+		return format
+	}
+	return FORMAT_TEXT
+}
+
+// documentText calls emit with the readable text of a document, a piece at
+// a time. columns is a comma separated list of CSV columns, by header name
+// or by number from 1.
+func documentText(r io.Reader, format string, columns string, emit func(text string)) error {
+	switch format {
+	case FORMAT_HTML:
+		return htmlText(r, emit)
+	case FORMAT_MARKDOWN:
+		return markdownText(r, emit)
+	case FORMAT_CSV:
+		return csvText(r, columns, emit)
+	case FORMAT_JSON:
+		return jsonText(r, emit)
+	}
+	// plain text goes word by word, a file without line breaks is not
+	// read whole. Every tokenizer splits at white space anyway, and a word
+	// longer than bufio.MaxScanTokenSize ends the reading.
+	scanner := bufio.NewScanner(r)
+	scanner.Split(bufio.ScanWords)
+	for scanner.Scan() {
+		emit(scanner.Text())
+	}
+	return scanner.Err()
+}
+
+// htmlText streams the text between the tags of a page. The content of
+// scripts, styles and comments is skipped, and every tag separates words,
+// <p>one</p><p>two</p> is not "onetwo".
+func htmlText(r io.Reader, emit func(text string)) error {
+	reader := bufio.NewReader(r)
+	var text strings.Builder
+	flush := func() {
+		if text.Len() > 0 {
+			emit(html.UnescapeString(text.String()))
+			text.Reset()
+		}
+	}
+	for {
+		b, err := reader.ReadByte()
+		if err == io.EOF {
+			flush()
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if b != '<' {
+			// long runs of text are handed on at a space, which splits no word or entity
+			if text.Len() >= 64<<10 && (b == ' ' || b == '\n') {
+				flush()
+			}
+			text.WriteByte(b)
+			continue
+		}
+		flush()
+		if err := skipTag(reader); err != nil && err != io.EOF {
+			return err
+		}
+	}
+}
+
+// skipTag reads a tag up to its closing '>', and past the end of a comment
+// or of the content of a script or style
+func skipTag(reader *bufio.Reader) error {
+	if head, _ := reader.Peek(3); string(head) == "!--" {
+		return skipPast(reader, "-->")
+	}
+	name := make([]byte, 0, 16)
+	closing, named, last := false, false, byte(0)
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b == '>' {
+			break
+		}
+		isName := b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9'
+		switch {
+		case b == '/' && len(name) == 0:
+			closing = true
+		case !named && isName && len(name) < 16:
+			name = append(name, b|0x20)
+		case len(name) > 0:
+			named = true
+		}
+		if b != ' ' && b != '\t' && b != '\n' && b != '\r' {
+			last = b
+		}
+	}
+	if closing || last == '/' {
+		return nil
+	}
+	switch string(name) {
+	case "script", "style", "noscript", "template":
+		return skipPast(reader, "</"+string(name))
+	}
+	return nil
+}
+
+// skipPast reads up to and including the first match of pattern, ignoring
+// case, and the rest of the tag if pattern starts a closing tag
+func skipPast(reader *bufio.Reader, pattern string) error {
+	window := make([]byte, 0, len(pattern))
+	for !strings.EqualFold(string(window), pattern) {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		if len(window) == len(pattern) {
+			window = window[1:]
+		}
+		window = append(window, b)
+	}
+	if strings.HasPrefix(pattern, "</") {
+		_, err := reader.ReadString('>')
+		return err
+	}
+	return nil
+}
+
+var (
+	mdFence      = regexp.MustCompile("^\\s*(```|~~~)")
+	mdReference  = regexp.MustCompile(`^\s*\[[^\]]+\]:\s`)
+	mdRule       = regexp.MustCompile(`^\s*([-*_=]\s*){3,}$`)
+	mdLineMarker = regexp.MustCompile(`^\s*(#{1,6}\s|>\s?|[-*+]\s+(\[[ xX]\]\s+)?|\d+[.)]\s+)+`)
+	mdLink       = regexp.MustCompile(`!?\[([^\]]*)\]\([^)]*\)|!?\[([^\]]*)\]\[[^\]]*\]`)
+	mdInline     = regexp.MustCompile("`[^`]*`|<[^>]+>")
+	mdEmphasis   = regexp.MustCompile(`[*_~|]+`)
+)
+
+func markdownText(r io.Reader, emit func(text string)) error {
+	reader := bufio.NewReader(r)
+	inCode := false
+	for {
+		line, err := reader.ReadString('\n')
+		if mdFence.MatchString(line) {
+			inCode = !inCode
+		} else if !inCode && !mdReference.MatchString(line) && !mdRule.MatchString(strings.TrimRight(line, "\r\n")) {
+			line = mdLineMarker.ReplaceAllString(line, "")
+			line = mdLink.ReplaceAllString(line, "$1$2")
+			line = mdInline.ReplaceAllString(line, " ")
+			emit(mdEmphasis.ReplaceAllString(line, " "))
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func csvText(r io.Reader, columns string, emit func(text string)) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	var selected []int
+	if columns != "" {
+		header, err := reader.Read()
+		if err != nil {
+			return err
+		}
+		var byName bool
+		if selected, byName = csvColumns(header, columns); !byName {
+			// the columns are numbered, so the first row is data
+			for _, i := range selected {
+				if i < len(header) {
+					emit(header[i])
+				}
+			}
+		}
+	}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if selected == nil {
+			emit(strings.Join(record, " "))
+			continue
+		}
+		for _, i := range selected {
+			if i >= 0 && i < len(record) {
+				emit(record[i])
+			}
+		}
+	}
+}
+
+// csvColumns resolves a list of columns against the header row, a column
+// that is not found is -1. byName tells whether any column was named, in
+// which case the header row is not counted.
+func csvColumns(header []string, columns string) (selected []int, byName bool) {
+	for _, column := range strings.Split(columns, ",") {
+		if n, err := strconv.Atoi(column); err == nil && n >= 1 {
+			selected = append(selected, n-1)
+			continue
+		}
+		byName = true
+		index := -1
+		for i, name := range header {
+			if strings.EqualFold(strings.TrimSpace(name), column) {
+				index = i
+				break
+			}
+		}
+		selected = append(selected, index)
+	}
+	return selected, byName
+}
+
+func jsonText(r io.Reader, emit func(text string)) error {
+	decoder := json.NewDecoder(r)
+	for {
+		var value interface{}
+		if err := decoder.Decode(&value); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		jsonStrings(value, emit)
+	}
+}
+
+// jsonStrings emits the string values of a decoded document, keys are
+// field names and are left out
+func jsonStrings(value interface{}, emit func(text string)) {
+	switch v := value.(type) {
+	case string:
+		emit(v)
+	case []interface{}:
+		for _, item := range v {
+			jsonStrings(item, emit)
+		}
+	case map[string]interface{}:
+		for _, item := range v {
+			jsonStrings(item, emit)
+		}
+	}
+}
+
+// checkDocuments finds problems with the files of an upload before it is
+// accepted, that is CSV columns missing from a header row. It returns the
+// reason and the file and column at fault.
+func checkDocuments(directory string, files []string, format string, columns string) (string, string, string) {
+	if columns == "" {
+		return "", "", ""
+	}
+	for _, file := range files {
+		if documentFormat(file, format) != FORMAT_CSV {
+			continue
+		}
+		fd, err := os.Open(directory + file)
+		if err != nil {
+			return "write failed", file, ""
+		}
+		reader := csv.NewReader(fd)
+		reader.FieldsPerRecord = -1
+		reader.LazyQuotes = true
+		header, _ := reader.Read()
+		fd.Close()
+		selected, _ := csvColumns(header, columns)
+		for i, index := range selected {
+			if index < 0 {
+				return "unknown column", file, strings.Split(columns, ",")[i]
+			}
+		}
+	}
+	return "", "", ""
+}
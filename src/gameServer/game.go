@@ -1,13 +1,14 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
 	"math"
 	"math/rand"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type GameState string
@@ -22,30 +23,56 @@ const (
 type Game struct {
 	gameID string
 	state  GameState
+	rules  gameRules
+	round  int // number of completed rounds
 
 	leader          string
 	picker          string // who picks the word
 	wordDict        map[string]int
 	fileName        string
-	tgtWord         string // target word
+	tgtWords        []string // target words of the round, nil until picked
 	usedWords       map[string]bool
-	waitingForGuess bool           // Flag to indicate if the game is ready for guessing
-	guessResults    map[string]int // To store player's guess results
+	waitingForGuess bool             // Flag to indicate if the game is ready for guessing
+	guessResults    map[string][]int // To store player's guess results, a count per target word
+	guessOrder      []string         // players in the order of their last guess, breaks ties
+	scores          map[string]int   // cumulative points over all rounds, see scores.go
+	guessDeadline   <-chan time.Time // fires when guessing closes, nil when not guessing or without a guess timeout
+	pickDeadline    <-chan time.Time // fires when the picker runs out of time, nil when not picking or without a pick timeout
+	upload          *uploadSession   // chunked upload in progress, see upload.go
+	files           []string         // files counted into wordDict, the upload or what was extracted from it, see archive.go
+	format          string           // format of the files, "" to go by their extensions, see formats.go
+	columns         string           // CSV columns to count
+
+	indexing <-chan map[string]int // delivers the word counts of the upload, nil when not counting, see index.go
 
 	names        map[string]chan map[string]string // players in this game and their mailboxes
 	namesDisconn map[string]chan map[string]string // players that lose connections
 	namesBye     map[string]chan map[string]string // players that have said goodbye
 	namesOrd     map[string]int                    // the order in which players join the game
+	spectators   map[string]chan map[string]string // players watching the game and their mailboxes
+	watchOrder   []string                          // spectators in the order they are promoted
+	chatBacklog  map[string][]map[string]string    // chat missed by disconnected players, delivered on RECONN
 	mailbox      chan map[string]string
 
+	disconnSince map[string]time.Time // when the disconnected players left, see session.go
+	expired      chan string          // a disconnected player may have run out of time
+
+	listed lobbyEntry // what the lobby was last told about the game, see lobby.go
+
 	directory string
+	journal   *os.File  // write-ahead log of game events, see journal.go
 	exit      chan bool // force exit channel
+	done      chan bool // closed when the routine returns
 	server    *GameServer
+
+	chanStatus     chan chan gameStatus // admin asks for the status of the game, see admin.go
+	chanAdminClose chan bool            // admin closes the game
 }
 
 func (game *Game) routine() {
 loop:
 	for {
+		game.publish()
 		select {
 		case mail := <-game.mailbox:
 			switch mail["cmd"] {
@@ -63,25 +90,47 @@ loop:
 				mailbox = <-game.server.chanPlayerResp
 				if game.state == WAITING || game.state == READY {
 					// ok to join
-					game.names[name] = mailbox
-					game.namesOrd[name] = len(game.namesOrd)
-					game.changeState()
-					response := map[string]string{"status": "success", "state": string(game.state), "leader": game.leader}
-					mailbox <- response
-					if len(game.names) == MIN_PLAYERS {
-						// notify the leader that the game is ready to start
-						notification := map[string]string{
-							"gameID": game.gameID,
-							"msg":    "READY",
-						}
-						game.names[game.leader] <- notification
+					game.addPlayer(name, mailbox)
+					response := map[string]string{
+						"status": "success",
+						"state":  string(game.state),
+						"leader": game.leader,
+						"rules":  strings.Join(game.rules.args(), " "),
 					}
+					mailbox <- response
+					game.notifyReady()
 				} else {
 					// unable to join
 					response := map[string]string{"status": "fail"}
 					mailbox <- response
 				}
 
+			case "WATCH":
+				name := mail["name"]
+				game.server.chanPlayerReq <- name
+				mailbox := <-game.server.chanPlayerResp
+				_, joined := game.names[name]
+				_, disconn := game.namesDisconn[name]
+				if joined || disconn {
+					mailbox <- map[string]string{"status": "fail", "reason": "already joined"}
+					continue
+				}
+				if _, ok := game.spectators[name]; ok {
+					mailbox <- map[string]string{"status": "fail", "reason": "already watching"}
+					continue
+				}
+				// spectators are not journaled, they stop watching when they disconnect
+				game.spectators[name] = mailbox
+				game.watchOrder = append(game.watchOrder, name)
+				mailbox <- map[string]string{
+					"status": "success",
+					"state":  string(game.state),
+					"leader": game.leader,
+				}
+
+			case "UNWATCH":
+				game.removeSpectator(mail["name"])
+
 			case "START":
 				name := mail["name"]
 				mailbox, ok := game.names[name]
@@ -113,12 +162,13 @@ loop:
 					response := map[string]string{
 						"status": "fail",
 						"reason": "not enough players",
-						"wait":   strconv.Itoa(MIN_PLAYERS - len(game.names)),
+						"wait":   strconv.Itoa(game.rules.minPlayers - len(game.names)),
 					}
 					mailbox <- response
 					continue
 				}
 				// start the game
+				game.record("start", nil)
 				game.state = RUNNING
 				response := map[string]string{"status": "success"}
 				mailbox <- response
@@ -133,6 +183,7 @@ loop:
 						v <- notification
 					}
 				}
+				game.notifySpectators(notification)
 
 			case "UPLOAD":
 				name := mail["name"]
@@ -149,6 +200,10 @@ loop:
 					mailbox <- response
 					continue
 				}
+				if !validFileName(fileName) {
+					game.names[name] <- map[string]string{"status": "fail", "reason": "invalid file name"}
+					continue
+				}
 				// check my directory to see if one file has the same name
 				entries, err := os.ReadDir(game.directory)
 				if err != nil {
@@ -169,58 +224,97 @@ loop:
 					mailbox <- response
 					continue
 				}
-				response := map[string]string{"status": "success", "path": game.directory}
+				if !game.takesUpload() {
+					// another file would pull the round out from under the picker
+					mailbox <- map[string]string{"status": "fail", "reason": "not now"}
+					continue
+				}
+				// the request carries the file, the game answers once
+				if err := os.WriteFile(game.directory+fileName, []byte(mail["data"]), 0644); err != nil {
+					mailbox <- map[string]string{"status": "fail", "reason": "not stored"}
+					continue
+				}
+				files, response := game.unpack(fileName, mail)
 				mailbox <- response
-				uploadStatus := <-game.mailbox
-				if uploadStatus["status"] != "success" {
+				if files != nil {
+					game.uploaded(fileName, files)
+				}
+
+			case "UPLOAD_BEGIN", "UPLOAD_CHUNK", "UPLOAD_COMMIT":
+				name := mail["name"]
+				mailbox, ok := game.names[name]
+				if !ok {
+					// the player did not join the game
+					game.server.chanPlayerReq <- name
+					mailbox = <-game.server.chanPlayerResp
+				}
+				if name != game.leader {
+					mailbox <- map[string]string{"status": "fail", "reason": "not a leader", "leader": game.leader}
 					continue
 				}
-				game.fileName = fileName
-				// choose a picker
-				names := make([]string, 0, len(game.names))
-				for name := range game.names {
-					if name != game.leader {
-						names = append(names, name)
-					}
+				if mail["cmd"] != "UPLOAD_CHUNK" && !game.takesUpload() {
+					mailbox <- map[string]string{"status": "fail", "reason": "not now"}
+					continue
 				}
-				game.picker = names[rand.Intn(len(names))]
-				// send a notification to the picker
-				notification := map[string]string{"gameID": game.gameID, "msg": "PICK", "filename": fileName}
-				game.names[game.picker] <- notification
-				// send a notification to everyone else
-				msg := map[string]string{"gameID": game.gameID, "msg": "UPLOADED"}
-				for name, mailbox := range game.names {
-					if name != game.picker {
-						mailbox <- msg
-					}
+				var response map[string]string
+				switch mail["cmd"] {
+				case "UPLOAD_BEGIN":
+					size, _ := strconv.Atoi(mail["size"])
+					response = game.beginUpload(uploadSession{fileName: mail["filename"], size: size, checksum: mail["sha256"],
+						format: mail["format"], columns: mail["columns"], save: mail["save"]})
+				case "UPLOAD_CHUNK":
+					response = game.writeChunk(mail["offset"], mail["data"])
+				default:
+					response = game.commitUpload()
 				}
-				// read the file, construct wordDict
-				fd, err := os.Open(game.directory + fileName)
-				if err != nil {
-					fmt.Printf("error: cannot open %s", game.directory+fileName)
-					os.Exit(-1)
+				var files []string
+				if mail["cmd"] == "UPLOAD_COMMIT" && response["status"] == "success" {
+					files, response = game.unpack(response["filename"], response)
 				}
-				scanner := bufio.NewScanner(fd)
-				for scanner.Scan() {
-					line := scanner.Text()
-					if line == "" {
-						continue
-					}
-					words := strings.Split(line, " ")
-					for _, word := range words {
-						_, ok := game.wordDict[word]
-						if !ok {
-							game.wordDict[word] = 1
-						} else {
-							game.wordDict[word]++
-						}
-					}
+				mailbox <- response
+				if files != nil {
+					game.uploaded(response["filename"], files)
+				}
+
+			case "USE_CORPUS":
+				name := mail["name"]
+				mailbox, ok := game.names[name]
+				if !ok {
+					// the player did not join the game
+					game.server.chanPlayerReq <- name
+					mailbox = <-game.server.chanPlayerResp
+				}
+				if name != game.leader {
+					mailbox <- map[string]string{"status": "fail", "reason": "not a leader", "leader": game.leader}
+					continue
+				}
+				if !game.takesUpload() {
+					mailbox <- map[string]string{"status": "fail", "reason": "not now"}
+					continue
+				}
+				corpus := mail["corpus"]
+				if reason := game.useCorpus(corpus); reason != "" {
+					mailbox <- map[string]string{"status": "fail", "reason": reason, "filename": corpus, "name": corpus}
+					continue
+				}
+				files, response := game.unpack(corpus, mail)
+				mailbox <- response
+				if files != nil {
+					game.uploaded(corpus, files)
 				}
-				fd.Close()
 
 			case "RANDOM_WORD":
 				name := mail["name"]
 				word := mail["word"]
+				if game.rules.picker == PICKER_SERVER {
+					mailbox, ok := game.names[name]
+					if !ok {
+						game.server.chanPlayerReq <- name
+						mailbox = <-game.server.chanPlayerResp
+					}
+					mailbox <- map[string]string{"status": "fail", "reason": "server picks"}
+					continue
+				}
 				if name != game.picker {
 					// not the picker
 					mailbox, ok := game.names[name]
@@ -240,23 +334,45 @@ loop:
 					mailbox <- resp
 					continue
 				}
-				_, inDict := game.wordDict[word]
-				_, used := game.usedWords[word]
-				if !inDict || used {
-					// the word is not in the file or has been used
-					resp := map[string]string{"status": "fail", "reason": "not a valid choice"}
+				if game.indexing != nil {
+					mailbox <- map[string]string{"status": "fail", "reason": "indexing"}
+					continue
+				}
+				words, resp := game.checkWords(strings.Fields(word))
+				if resp != nil {
 					mailbox <- resp
 					continue
 				}
-				// successfully uploaded the word
-				mailbox <- map[string]string{"status": "success"}
-				game.tgtWord = word
-				// notify everyone
-				notification := map[string]string{"gameID": game.gameID, "msg": "WORD_SELECTED", "word": game.tgtWord}
-				for _, box := range game.names {
-					box <- notification
+				// successfully uploaded the words
+				game.record("pick", map[string]string{"word": strings.Join(words, " ")})
+				mailbox <- map[string]string{"status": "success", "word": strings.Join(words, " ")}
+				game.selectWords(words)
+
+			case "HINTS":
+				name := mail["name"]
+				mailbox, ok := game.names[name]
+				if !ok || name != game.picker {
+					if !ok {
+						game.server.chanPlayerReq <- name
+						mailbox = <-game.server.chanPlayerResp
+					}
+					reason := "not a picker"
+					if game.rules.picker == PICKER_SERVER {
+						reason = "server picks"
+					}
+					mailbox <- map[string]string{"status": "fail", "reason": reason, "picker": game.picker}
+					continue
+				}
+				switch {
+				case game.fileName == "":
+					mailbox <- map[string]string{"status": "fail", "reason": "file not ready", "leader": game.leader}
+				case game.indexing != nil:
+					mailbox <- map[string]string{"status": "fail", "reason": "indexing"}
+				case game.tgtWords != nil:
+					mailbox <- map[string]string{"status": "fail", "reason": "word selected"}
+				default:
+					mailbox <- game.hints()
 				}
-				game.waitingForGuess = true // wait for players to submit their guesses
 
 			case "WORD_COUNT":
 				// Only process WORD_COUNT if the game is in the correct state
@@ -275,8 +391,12 @@ loop:
 					mailbox <- resp
 					continue
 				}
-				count := mail["guess"]
-				guess, err := strconv.Atoi(count)
+				if name == game.leader && !game.rules.leaderGuess {
+					resp := map[string]string{"status": "fail", "reason": "leader may not guess"}
+					mailbox <- resp
+					continue
+				}
+				guess, err := parseGuess(mail["guess"])
 
 				if err != nil {
 					// Handle invalid guess format
@@ -284,30 +404,106 @@ loop:
 					mailbox <- resp
 					continue
 				}
+				if len(guess) != len(game.tgtWords) {
+					mailbox <- map[string]string{"status": "fail", "reason": "wrong number of guesses", "words": strconv.Itoa(len(game.tgtWords))}
+					continue
+				}
 
 				// Record the player's guess
-				game.guessResults[name] = guess
+				game.record("guess", map[string]string{"name": name, "guess": formatGuess(guess)})
+				game.addGuess(name, guess)
 				// return success
 				mailbox <- map[string]string{"status": "success"}
 
 				// Check if all players have made their guesses
-				if len(game.guessResults) >= len(game.names) {
-					game.waitingForGuess = false
-					winner := game.determineWinner(game.wordDict[game.tgtWord])
-					for _, mailbox := range game.names {
-						notification := map[string]string{
-							"gameID": game.gameID,
-							"msg":    "WINNER",
-							"name":   winner,
-						}
-						mailbox <- notification
+				if len(game.guessResults) >= game.guessers() {
+					game.announceWinner()
+				}
+
+			case "SCORES":
+				name := mail["name"]
+				mailbox, ok := game.names[name]
+				if !ok {
+					game.server.chanPlayerReq <- name
+					mailbox = <-game.server.chanPlayerResp
+				}
+				mailbox <- map[string]string{
+					"status": "success",
+					"round":  strconv.Itoa(game.round),
+					"scores": formatScores(game.scores),
+				}
+
+			case "STATUS":
+				name := mail["name"]
+				roles := make([]string, 0, 2)
+				mailbox, ok := game.names[name]
+				if ok {
+					if name == game.leader {
+						roles = append(roles, "leader")
+					}
+					if name == game.picker {
+						roles = append(roles, "picker")
 					}
+					if len(roles) == 0 {
+						roles = append(roles, "player")
+					}
+				} else if mailbox, ok = game.spectators[name]; ok {
+					roles = append(roles, "spectator")
+				} else {
+					// the player did not join the game
+					game.server.chanPlayerReq <- name
+					mailbox = <-game.server.chanPlayerResp
+					mailbox <- map[string]string{"status": "fail", "reason": "did not join the game"}
+					continue
+				}
+				mailbox <- map[string]string{
+					"status": "success",
+					"state":  string(game.state),
+					"roles":  strings.Join(roles, ","),
+					"round":  strconv.Itoa(game.round),
+				}
+
+			case "SAY":
+				name := mail["name"]
+				mailbox, ok := game.names[name]
+				if !ok {
+					// the player did not join the game
+					game.server.chanPlayerReq <- name
+					mailbox = <-game.server.chanPlayerResp
+					mailbox <- map[string]string{"status": "fail", "reason": "did not join the game"}
+					continue
+				}
+				mailbox <- map[string]string{"status": "success"}
+				// chat is not journaled, it does not change the game
+				notification := map[string]string{
+					"gameID": game.gameID,
+					"msg":    "CHAT",
+					"from":   name,
+					"text":   mail["text"],
+				}
+				for nm, box := range game.names {
+					if nm != name {
+						box <- notification
+					}
+				}
+				for nm := range game.namesDisconn {
+					backlog := append(game.chatBacklog[nm], notification)
+					if len(backlog) > CHAT_BACKLOG {
+						// keep the latest messages
+						backlog = backlog[len(backlog)-CHAT_BACKLOG:]
+					}
+					game.chatBacklog[nm] = backlog
 				}
 
 			case "DISCONN":
 				name := mail["name"]
+				if _, ok := game.names[name]; !ok {
+					// the seat was released meanwhile
+					continue
+				}
 				game.namesDisconn[name] = game.names[name]
 				delete(game.names, name)
+				game.armExpiry(name)
 				if game.state != RUNNING {
 					game.changeState()
 				}
@@ -322,6 +518,7 @@ loop:
 							newLeader = name
 						}
 					}
+					game.record("leader", map[string]string{"name": newLeader})
 					game.leader = newLeader
 					msg := map[string]string{"gameID": game.gameID, "msg": "NEW_LEADER", "leader": game.leader}
 					for _, mailbox := range game.names {
@@ -331,13 +528,43 @@ loop:
 
 			case "RECONN":
 				name := mail["name"]
-				game.names[name] = game.namesDisconn[name]
+				mailbox, ok := game.namesDisconn[name]
+				if !ok {
+					// still seated, the game has not heard of the old
+					// connection yet
+					mailbox, ok = game.names[name]
+				}
+				if !ok {
+					// the seat was released while the player was away
+					game.server.chanPlayerReq <- name
+					mailbox = <-game.server.chanPlayerResp
+					mailbox <- map[string]string{"status": "fail", "reason": "expired"}
+					continue
+				}
+				game.names[name] = mailbox
 				delete(game.namesDisconn, name)
+				delete(game.disconnSince, name)
 				if game.state != RUNNING {
 					game.changeState()
 				}
+				if game.leader == "" {
+					// everybody had left, the first one back leads and may resume the upload
+					game.record("leader", map[string]string{"name": name})
+					game.leader = name
+				}
 				resp := map[string]string{"status": "success", "leader": game.leader, "state": string(game.state)}
+				if game.upload != nil && name == game.leader {
+					// tell the leader where to resume its upload
+					resp["upload"] = game.upload.fileName
+					resp["offset"] = strconv.Itoa(game.upload.received)
+					resp["size"] = strconv.Itoa(game.upload.size)
+				}
 				game.names[name] <- resp
+				// catch up on the chat missed while disconnected
+				for _, notification := range game.chatBacklog[name] {
+					game.names[name] <- notification
+				}
+				delete(game.chatBacklog, name)
 
 			case "RESTART":
 				name := mail["name"]
@@ -348,19 +575,28 @@ loop:
 					mailbox = <-game.server.chanPlayerResp
 				}
 				if name != game.leader {
-					mailbox <- map[string]string{"status": "fail"}
+					mailbox <- map[string]string{"status": "fail", "reason": "not a leader", "leader": game.leader}
+					continue
+				}
+				if game.rules.rounds > 0 && game.round >= game.rules.rounds {
+					mailbox <- map[string]string{"status": "fail", "reason": "no rounds left", "rounds": strconv.Itoa(game.rules.rounds)}
 					continue
 				}
+				game.record("restart", nil)
 				mailbox <- map[string]string{"status": "success"}
 				// restart the game
 				game.changeState()
 				game.picker = ""
-				if game.tgtWord != "" {
-					game.usedWords[game.tgtWord] = true
-					game.tgtWord = ""
+				game.fileName = ""
+				for _, word := range game.tgtWords {
+					game.usedWords[word] = true
 				}
+				game.tgtWords = nil
 				game.waitingForGuess = false
-				game.guessResults = make(map[string]int)
+				game.guessDeadline = nil
+				game.pickDeadline = nil
+				game.guessResults = make(map[string][]int)
+				game.guessOrder = nil
 				// send notifications about the restart to everyone
 				notification := map[string]string{
 					"gameID": game.gameID,
@@ -369,6 +605,7 @@ loop:
 				for _, box := range game.names {
 					box <- notification
 				}
+				game.promoteSpectators()
 
 			case "CLOSE":
 				name := mail["name"]
@@ -382,6 +619,7 @@ loop:
 					mailbox <- map[string]string{"status": "fail"}
 					continue
 				}
+				game.record("close", nil)
 				game.cleanup(false)
 				mailbox <- map[string]string{"status": "success"}
 				// close the game, notify everyone
@@ -392,12 +630,14 @@ loop:
 				for _, box := range game.names {
 					box <- notification
 				}
+				game.notifySpectators(notification)
 				break loop
 
 			case "GOODBYE":
 				name := mail["name"]
 				if name == game.leader {
 					// close the game
+					game.record("close", nil)
 					game.cleanup(false)
 					game.names[name] <- map[string]string{"status": "success"}
 					notification := map[string]string{
@@ -412,33 +652,106 @@ loop:
 					for _, box := range game.namesBye {
 						box <- notification
 					}
+					game.notifySpectators(notification)
 					break loop
 				}
+				game.record("leave", map[string]string{"name": name})
 				game.names[name] <- map[string]string{"status": "success"}
 				game.namesBye[name] = game.names[name]
 				delete(game.names, name)
 				if game.state == RUNNING {
-					if name == game.picker && game.tgtWord == "" {
+					if name == game.picker && game.tgtWords == nil {
 						// picker has not chosen the word, choose a new picker
-						names := make([]string, 0, len(game.names))
-						for name := range game.names {
-							if name != game.leader {
-								names = append(names, name)
-							}
-						}
-						game.picker = names[rand.Intn(len(names))]
+						game.picker = game.choosePicker("")
+						game.record("picker", map[string]string{"name": game.picker})
 						// send a notification to the picker
-						notification := map[string]string{
-							"gameID":   game.gameID,
-							"msg":      "PICK",
-							"filename": game.fileName,
-						}
-						game.names[game.picker] <- notification
+						game.notifyPicker()
+						game.armPickDeadline()
 					}
 				} else {
 					game.changeState()
+					game.promoteSpectators()
+				}
+			}
+		case counts := <-game.indexing:
+			game.indexing = nil
+			game.indexed(counts)
+			if game.state == RUNNING && game.tgtWords == nil {
+				if game.rules.picker == PICKER_SERVER {
+					game.pickForServer()
+					continue
 				}
+				game.notifyPicker()
+				game.armPickDeadline()
 			}
+
+		case <-game.pickDeadline:
+			// the picker is out of time, hand the pick to someone else
+			game.pickDeadline = nil
+			if game.state == RUNNING && game.tgtWords == nil {
+				late := game.picker
+				game.picker = game.choosePicker(late)
+				game.record("picker", map[string]string{"name": game.picker})
+				notification := map[string]string{
+					"gameID": game.gameID,
+					"msg":    "TIMEOUT",
+					"phase":  "pick",
+					"name":   late,
+					"picker": game.picker,
+				}
+				for _, box := range game.names {
+					box <- notification
+				}
+				game.notifyPicker()
+				game.armPickDeadline()
+			}
+
+		case <-game.guessDeadline:
+			// time is up, the guesses received so far decide the round
+			game.guessDeadline = nil
+			if game.waitingForGuess {
+				missing := make([]string, 0)
+				for name := range game.names {
+					_, guessed := game.guessResults[name]
+					if !guessed && (name != game.leader || game.rules.leaderGuess) {
+						missing = append(missing, name)
+					}
+				}
+				sort.Strings(missing)
+				notification := map[string]string{
+					"gameID":  game.gameID,
+					"msg":     "TIMEOUT",
+					"phase":   "guess",
+					"missing": strings.Join(missing, ","),
+				}
+				for _, box := range game.names {
+					box <- notification
+				}
+				game.announceWinner()
+			}
+
+		case reply := <-game.chanStatus:
+			reply <- game.status()
+
+		case <-game.chanAdminClose:
+			// closed by an operator, as if the leader had closed it
+			game.record("close", nil)
+			game.cleanup(false)
+			notification := map[string]string{
+				"gameID": game.gameID,
+				"msg":    "CLOSED",
+			}
+			for _, box := range game.names {
+				box <- notification
+			}
+			game.notifySpectators(notification)
+			break loop
+
+		case name := <-game.expired:
+			if game.expire(name) {
+				break loop
+			}
+
 		case <-game.exit:
 			game.cleanup(true)
 			break loop
@@ -446,9 +759,13 @@ loop:
 	}
 }
 
+// cleanup releases the game. A closed game deletes its directory, while a
+// game terminated by a server shutdown keeps it so the journal can be
+// replayed on the next start.
 func (game *Game) cleanup(terminate bool) {
-	os.RemoveAll(game.directory)
+	game.closeJournal()
 	if !terminate {
+		os.RemoveAll(game.directory)
 		game.server.chanGameExit <- game.gameID
 		<-game.server.chanGameExitResp
 	} else {
@@ -459,30 +776,355 @@ func (game *Game) cleanup(terminate bool) {
 		for _, mailbox := range game.namesBye {
 			mailbox <- map[string]string{"gameID": game.gameID, "msg": "EXIT"}
 		}
+		game.notifySpectators(map[string]string{"gameID": game.gameID, "msg": "EXIT"})
 		game.exit <- true // confirm to server
 	}
+	close(game.done)
 	close(game.mailbox)
 }
 
-func (game *Game) determineWinner(actualWordCount int) string {
-	minDiff := math.MaxInt32
-	var winner string
+// unpack extracts an upload and checks that its files can be counted, see
+// archive.go and formats.go, then saves it to the corpus library if asked
+// to, see library.go. The format, columns and save name are taken from
+// options. A file that cannot be used is removed with whatever came out of it.
+func (game *Game) unpack(fileName string, options map[string]string) ([]string, map[string]string) {
+	files, reason := unpackUpload(game.directory, fileName)
+	if reason != "" {
+		os.Remove(game.directory + fileName)
+		return nil, map[string]string{"status": "fail", "reason": reason, "filename": archiveBase(fileName)}
+	}
+	discard := func() {
+		os.Remove(game.directory + fileName)
+		if files[0] != fileName {
+			os.RemoveAll(game.directory + archiveBase(fileName))
+		}
+	}
+	reason, file, column := checkDocuments(game.directory, files, options["format"], options["columns"])
+	if reason != "" {
+		discard()
+		return nil, map[string]string{"status": "fail", "reason": reason, "filename": file, "column": column}
+	}
+	if options["save"] != "" {
+		if reason := game.saveCorpus(options["save"], fileName); reason != "" {
+			discard()
+			return nil, map[string]string{"status": "fail", "reason": reason, "filename": fileName, "name": options["save"]}
+		}
+	}
+	game.format, game.columns = options["format"], options["columns"]
+	return files, map[string]string{"status": "success", "filename": fileName}
+}
+
+// takesUpload tells whether the leader may provide the file of the round:
+// the game is running and the picking has not started
+func (game *Game) takesUpload() bool {
+	return game.state == RUNNING && game.fileName == ""
+}
+
+// uploaded starts the round once the leader's file is in place and
+// unpacked
+func (game *Game) uploaded(fileName string, files []string) {
+	game.fileName = fileName
+	game.files = files
+	// choose a picker, nobody when the server picks
+	game.picker = ""
+	if game.rules.picker == PICKER_PLAYER {
+		game.picker = game.choosePicker("")
+	}
+	game.record("upload", map[string]string{"filename": fileName, "files": strings.Join(files, ","),
+		"format": game.format, "columns": game.columns, "picker": game.picker})
+	// the picker is asked once the words are counted
+	game.startIndexing()
+	// send a notification to everyone else
+	msg := map[string]string{"gameID": game.gameID, "msg": "UPLOADED"}
+	for name, mailbox := range game.names {
+		if name != game.picker {
+			mailbox <- msg
+		}
+	}
+	game.notifySpectators(msg)
+}
+
+// addGuess records a guess, a player that guesses again moves to the back
+func (game *Game) addGuess(name string, guess []int) {
+	if _, ok := game.guessResults[name]; ok {
+		for i, n := range game.guessOrder {
+			if n == name {
+				game.guessOrder = append(game.guessOrder[:i], game.guessOrder[i+1:]...)
+				break
+			}
+		}
+	}
+	game.guessResults[name] = guess
+	game.guessOrder = append(game.guessOrder, name)
+}
+
+// actualCounts returns the counts of the target words
+func (game *Game) actualCounts() []int {
+	counts := make([]int, len(game.tgtWords))
+	for i, word := range game.tgtWords {
+		counts[i] = game.wordDict[word]
+	}
+	return counts
+}
 
+// distances returns how far off every guess is from the actual counts,
+// added up over the target words
+func (game *Game) distances(actual []int) map[string]int {
+	distances := make(map[string]int, len(game.guessResults))
 	for name, guess := range game.guessResults {
-		diff := math.Abs(float64(guess - actualWordCount))
-		if int(diff) < minDiff {
-			minDiff = int(diff)
-			winner = name
+		for i, count := range actual {
+			if i < len(guess) {
+				distances[name] += int(math.Abs(float64(guess[i] - count)))
+			}
+		}
+	}
+	return distances
+}
+
+// determineWinner returns the closest guesses in the order they were made,
+// cut down to the earliest one unless the game shares ties. Nobody wins
+// without a guess.
+func (game *Game) determineWinner(actual []int) []string {
+	distances := game.distances(actual)
+	minDiff := math.MaxInt32
+	winners := make([]string, 0)
+
+	for _, name := range game.guessOrder {
+		if distances[name] < minDiff {
+			minDiff = distances[name]
+			winners = winners[:0]
+		}
+		if distances[name] == minDiff {
+			winners = append(winners, name)
+		}
+	}
+
+	if game.rules.ties == TIES_FIRST && len(winners) > 1 {
+		winners = winners[:1]
+	}
+	return winners
+}
+
+// choosePicker returns a random connected player other than the leader,
+// preferring anyone but exclude, or "" if there is nobody to pick
+func (game *Game) choosePicker(exclude string) string {
+	names := make([]string, 0, len(game.names))
+	for name := range game.names {
+		if name != game.leader && name != exclude {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		if _, ok := game.names[exclude]; ok && exclude != game.leader {
+			return exclude
+		}
+		return ""
+	}
+	sort.Strings(names)
+	return names[rand.Intn(len(names))]
+}
+
+// checkWords checks the words a picker sends against the file and the pick
+// rules, and returns them as the tokenizer counts them, or the response
+// refusing them
+func (game *Game) checkWords(words []string) ([]string, map[string]string) {
+	if len(words) != game.rules.words {
+		return nil, map[string]string{"status": "fail", "reason": "wrong number of words", "words": strconv.Itoa(game.rules.words)}
+	}
+	stopWords := game.rules.stopList()
+	checked := make([]string, 0, len(words))
+	for _, word := range words {
+		// the word is counted as the tokenizer counts the file
+		raw, inDict, used := word, false, false
+		if tokens := game.rules.Tokenizer().Tokens(word); len(tokens) == 1 {
+			word = tokens[0]
+			_, inDict = game.wordDict[word]
+			_, used = game.usedWords[word]
+		}
+		for _, w := range checked {
+			used = used || w == word
 		}
+		if !inDict || used {
+			// the word is not in the file or has been used
+			return nil, map[string]string{"status": "fail", "reason": "not a valid choice", "word": raw}
+		}
+		if reason := game.pickable(word, stopWords); reason != "" {
+			return nil, map[string]string{"status": "fail", "reason": reason, "word": word}
+		}
+		checked = append(checked, word)
 	}
+	return checked, nil
+}
 
-	return winner
+// selectWords starts the guessing once the words are picked
+func (game *Game) selectWords(words []string) {
+	game.pickDeadline = nil
+	game.tgtWords = words
+	// notify everyone
+	notification := map[string]string{"gameID": game.gameID, "msg": "WORD_SELECTED", "word": strings.Join(words, " ")}
+	for _, box := range game.names {
+		box <- notification
+	}
+	game.notifySpectators(notification)
+	game.waitingForGuess = true // wait for players to submit their guesses
+	game.armGuessDeadline()
+}
+
+// pickForServer picks the words in games where the server picks, or tells
+// everyone that the pick rules leave too few words to pick
+func (game *Game) pickForServer() {
+	words := game.serverPick()
+	if words == nil {
+		notification := map[string]string{"gameID": game.gameID, "msg": "NO_WORD", "leader": game.leader}
+		for _, box := range game.names {
+			box <- notification
+		}
+		game.notifySpectators(notification)
+		return
+	}
+	game.record("pick", map[string]string{"word": strings.Join(words, " ")})
+	game.selectWords(words)
+}
+
+// notifyPicker asks the picker to pick a word from the uploaded file
+func (game *Game) notifyPicker() {
+	if game.indexing != nil {
+		// asked once the words are counted
+		return
+	}
+	mailbox, ok := game.names[game.picker]
+	if !ok {
+		// nobody to pick, the pick deadline tries again
+		return
+	}
+	mailbox <- map[string]string{"gameID": game.gameID, "msg": "PICK", "filename": game.fileName, "files": strings.Join(game.files, ",")}
+}
+
+// armPickDeadline starts the pick timeout of the rules, if any
+func (game *Game) armPickDeadline() {
+	game.pickDeadline = nil
+	if game.indexing != nil {
+		// the time starts once the words are counted
+		return
+	}
+	if game.rules.pickTimeout > 0 {
+		game.pickDeadline = time.After(game.rules.pickTimeout)
+	}
+}
+
+// armGuessDeadline starts the guess timeout of the rules, if any
+func (game *Game) armGuessDeadline() {
+	game.guessDeadline = nil
+	if game.rules.guessTimeout > 0 {
+		game.guessDeadline = time.After(game.rules.guessTimeout)
+	}
+}
+
+// addPlayer seats a player that joins the game
+func (game *Game) addPlayer(name string, mailbox chan map[string]string) {
+	game.record("join", map[string]string{"name": name})
+	game.removeSpectator(name)
+	game.names[name] = mailbox
+	game.namesOrd[name] = len(game.namesOrd)
+	game.changeState()
+}
+
+// notifyReady tells the leader once enough players have joined to start
+func (game *Game) notifyReady() {
+	if len(game.names) == game.rules.minPlayers {
+		notification := map[string]string{
+			"gameID": game.gameID,
+			"msg":    "READY",
+		}
+		game.names[game.leader] <- notification
+	}
+}
+
+func (game *Game) removeSpectator(name string) {
+	if _, ok := game.spectators[name]; !ok {
+		return
+	}
+	delete(game.spectators, name)
+	for i, n := range game.watchOrder {
+		if n == name {
+			game.watchOrder = append(game.watchOrder[:i], game.watchOrder[i+1:]...)
+			break
+		}
+	}
+}
+
+func (game *Game) notifySpectators(notification map[string]string) {
+	for _, box := range game.spectators {
+		box <- notification
+	}
+}
+
+// promoteSpectators seats the longest watching spectators while the game
+// is not running and has free seats. Disconnected players keep their seats.
+func (game *Game) promoteSpectators() {
+	for game.state != RUNNING && len(game.watchOrder) > 0 &&
+		len(game.names)+len(game.namesDisconn) < game.rules.maxPlayers {
+		name := game.watchOrder[0]
+		mailbox := game.spectators[name]
+		game.addPlayer(name, mailbox)
+		mailbox <- map[string]string{
+			"gameID": game.gameID,
+			"msg":    "PROMOTED",
+			"state":  string(game.state),
+			"leader": game.leader,
+		}
+		game.notifyReady()
+	}
+}
+
+// guessers is the number of connected players expected to guess
+func (game *Game) guessers() int {
+	if _, ok := game.names[game.leader]; ok && !game.rules.leaderGuess {
+		return len(game.names) - 1
+	}
+	return len(game.names)
+}
+
+// announceWinner closes guessing and notifies everyone of the winner
+func (game *Game) announceWinner() {
+	game.waitingForGuess = false
+	game.guessDeadline = nil
+	actual := game.actualCounts()
+	winners := game.determineWinner(actual)
+	game.record("winner", map[string]string{"names": strings.Join(winners, ",")})
+	game.scoreRound(actual)
+	game.round++
+	final := game.rules.rounds > 0 && game.round >= game.rules.rounds
+	// standings are worth showing to text players once there are several rounds
+	multiRound := game.round > 1 || game.rules.rounds > 1
+	winner := ""
+	if len(winners) > 0 {
+		winner = winners[0]
+	}
+	notification := map[string]string{
+		"gameID":     game.gameID,
+		"msg":        "WINNER",
+		"name":       winner,
+		"winners":    strings.Join(winners, ","),
+		"distances":  formatDistances(game.distances(actual)),
+		"final":      strconv.FormatBool(final),
+		"count":      strconv.Itoa(actual[0]),
+		"words":      strings.Join(game.tgtWords, " "),
+		"counts":     formatGuess(actual),
+		"round":      strconv.Itoa(game.round),
+		"scores":     formatScores(game.scores),
+		"multiRound": strconv.FormatBool(multiRound),
+	}
+	for _, mailbox := range game.names {
+		mailbox <- notification
+	}
+	game.notifySpectators(notification)
 }
 
 func (game *Game) changeState() {
-	if len(game.names) < MIN_PLAYERS {
+	if len(game.names) < game.rules.minPlayers {
 		game.state = WAITING
-	} else if len(game.names) < MAX_PLAYERS {
+	} else if len(game.names) < game.rules.maxPlayers {
 		game.state = READY
 	} else {
 		game.state = FULL
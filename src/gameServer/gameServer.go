@@ -8,14 +8,38 @@ import (
 	"net"
 	"os"
 	"strings"
+	"time"
 )
 
 const (
 	RunningProtocol      string = "tcp"
+	UnixProtocol         string = "unix"
 	ServerAddress        string = "localhost:9999"
 	StorageDirectoryName string = "serverStorage/"
 	MIN_PLAYERS          int    = 4
 	MAX_PLAYERS          int    = 8
+	PICK_TIMEOUT         int    = 120 // default seconds for the picker to pick a word
+	GUESS_TIMEOUT        int    = 120 // default seconds for the players to guess
+	MAX_CHAT_LENGTH      int    = 200 // longest text of a SAY or WHISPER
+	CHAT_BACKLOG         int    = 32  // chat messages kept for a player until it reads them
+
+	MAX_LINE_LENGTH int = 64 << 10 // longest command line in bytes, but for the data of a FILE_UPLOAD
+	MAX_UPLOAD_SIZE int = 16 << 20 // largest FILE_UPLOAD in bytes
+	UPLOAD_TIMEOUT  int = 30       // seconds to receive the data of a FILE_UPLOAD
+	MAX_CORPUS_SIZE int = 1 << 30  // largest file sent in chunks, see upload.go
+
+	MAX_ARCHIVE_FILES int = 1000 // most files extracted from one archive, see archive.go
+	MAX_ARCHIVE_RATIO int = 100  // most an archive may expand, as a multiple of its size
+
+	HINT_WORDS      int = 5 // most candidates of a frequency band in HINTS, see hints.go
+	MAX_ROUND_WORDS int = 5 // most target words of a round, the "words" rule
+
+	AUTH_ROUNDS   int = 10000 // rounds of SHA-256 in a password hash, see auth.go
+	AUTH_ATTEMPTS int = 3     // failed logins before the connection is closed
+
+	SESSION_TIMEOUT int = 0 // default seconds a disconnected player keeps its seats, 0 for ever, see session.go
+
+	LOBBY_BACKLOG int = 32 // lobby news kept for a player until it reads them, see lobby.go
 )
 
 var RootDir, _ = os.Getwd()
@@ -23,67 +47,206 @@ var RootDir, _ = os.Getwd()
 // GameServer holds the structure of our word count game server
 // implementation.
 type GameServer struct {
-	addr    string
+	addrs   []listenAddr
 	players map[string]*Player
 	games   map[string]*Game
 
-	chanName   chan string  // player sends name to server ...
-	chanPlayer chan *Player // ... and receives a Player object
+	chanName   chan helloRequest  // player sends name and credentials to server ...
+	chanPlayer chan helloResponse // ... and receives a Player object, see auth.go
 
-	chanGameReq chan struct {
-		gameID  string
-		name    string
-		newGame bool
-	} // player sends a request for a game (existing or new) ...
+	chanSaltReq  chan string // player sends a name before it hashes its password ...
+	chanSaltResp chan string // ... and receives the salt of the name
+
+	chanGameReq  chan gameRequest            // player sends a request for a game (existing or new) ...
 	chanGameResp chan chan map[string]string // .. and receives its mailbox
 
 	chanPlayerReq  chan string                 // game sends a player name to server ...
 	chanPlayerResp chan chan map[string]string // ... and receives its mailbox
 
+	chanChatReq  chan string                 // player sends the name of a whisper's recipient ...
+	chanChatResp chan chan map[string]string // ... and receives its chat channel, nil if there is no such player
+
 	chanGameExit     chan string // gameID of a exited game
 	chanGameExitResp chan bool
 	chanPlayerExit   chan string // name of a exited player
 	chanShutdown     chan bool   // shut down game server
 
+	chanLibraryReq chan libraryRequest // games, players and the admin use the corpus library, see library.go
+	chanLobbyReq   chan lobbyRequest   // games tell the lobby about themselves and players read it, see lobby.go
+
+	chanOnline    chan playerConn    // player tells the server it disconnected, HELLO tells it the player connected
+	chanAdminReq  chan bool          // admin asks for ...
+	chanAdminResp chan adminSnapshot // ... the games and the connected players, see admin.go
+
 	directory string // storage directory
-	listener  *net.Listener
+	listeners []net.Listener
+	ready     chan bool // closed once the listeners are bound (or failed to)
+	done      chan bool // closed when Run returns
+	stopping  chan bool // closed when the server routine stops serving, before the games exit
+
+	conns         map[string]playerConn // connections of the players that are online
+	adminListener net.Listener          // admin socket, nil without one
+	library       *corpusLibrary        // owned by the server routine
+	accounts      *accountStore         // owned by the server routine
+
+	sessions       map[string]*session // by token, owned by the server routine, see session.go
+	sessionTimeout time.Duration       // how long a disconnected player keeps its session
+
+	lobby         map[string]lobbyEntry             // the latest entry of every game, by gameID, see lobby.go
+	lobbyWatchers map[string]chan map[string]string // players that watch the lobby and where they are told
 }
 
-func (server *GameServer) Run() (err error) {
-	listener, err := net.Listen(RunningProtocol, ServerAddress)
+// gameRequest asks the server for the mailbox of a game, creating the
+// game with the given rules if newGame is set.
+type gameRequest struct {
+	gameID  string
+	name    string
+	newGame bool
+	rules   gameRules
+}
+
+// listenAddr is one address the server accepts connections on.
+type listenAddr struct {
+	network string // RunningProtocol or UnixProtocol
+	address string // host:port or socket path
+}
+
+// parseAddrs splits a comma separated address list. Entries prefixed with
+// "unix:" are Unix domain sockets, "tcp:" forces TCP, and entries without a
+// prefix use the given default protocol.
+func parseAddrs(protocol, addr string) ([]listenAddr, error) {
+	addrs := make([]listenAddr, 0)
+	for _, entry := range strings.Split(addr, ",") {
+		entry = strings.TrimSpace(entry)
+		network := protocol
+		if strings.HasPrefix(entry, UnixProtocol+":") {
+			network, entry = UnixProtocol, strings.TrimPrefix(entry, UnixProtocol+":")
+		} else if strings.HasPrefix(entry, RunningProtocol+":") {
+			network, entry = RunningProtocol, strings.TrimPrefix(entry, RunningProtocol+":")
+		}
+		if entry == "" {
+			return nil, errors.New("empty listening address")
+		}
+		addrs = append(addrs, listenAddr{network: network, address: entry})
+	}
+	return addrs, nil
+}
+
+// listen binds the address
+func (addr listenAddr) listen() (net.Listener, error) {
+	if addr.network == UnixProtocol {
+		// remove a socket left behind by a crashed server
+		if info, err := os.Stat(addr.address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(addr.address)
+		}
+	}
+	listener, err := net.Listen(addr.network, addr.address)
 	if err != nil {
-		fmt.Println(err)
-		return
-	}
-	server.listener = &listener
-	// launch a routine to accept TCP connections and dispatch them to clientRoutine
-	go func() {
-		for {
-			conn, err := listener.Accept()
-			if err != nil {
-				break
+		return nil, fmt.Errorf("listen on %s %s: %w", addr.network, addr.address, err)
+	}
+	return listener, nil
+}
+
+// loopback tells whether the address only takes connections from this host
+func (addr listenAddr) loopback() bool {
+	if addr.network == UnixProtocol {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr.address)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return host == "localhost" || ip != nil && ip.IsLoopback()
+}
+
+// listen binds every configured address, closing the ones already bound if
+// any of them fails.
+func (server *GameServer) listen() error {
+	defer close(server.ready)
+	for _, addr := range server.addrs {
+		listener, err := addr.listen()
+		if err != nil {
+			for _, l := range server.listeners {
+				l.Close()
 			}
-			go clientRoutine(conn, server)
+			server.listeners = nil
+			return err
 		}
-	}()
+		log.Printf("game server listening on %s %s", listener.Addr().Network(), listener.Addr())
+		server.listeners = append(server.listeners, listener)
+	}
+	return nil
+}
+
+func (server *GameServer) Run() (err error) {
+	defer close(server.done)
+	if err = server.listen(); err != nil {
+		return err
+	}
+	// start the recovered games, their seats expire like the seats of any
+	// disconnected player, now that the session timeout is set
+	for _, game := range server.games {
+		for name := range game.namesDisconn {
+			game.armExpiry(name)
+		}
+		go game.routine()
+	}
+	// launch routines to accept connections and dispatch them to clientRoutine
+	for _, listener := range server.listeners {
+		go func(listener net.Listener) {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					break
+				}
+				go clientRoutine(conn, server)
+			}
+		}(listener)
+	}
 
 	// server routine provides services to games and players outside a game
 loop:
 	for {
 		select {
-		case name := <-server.chanName:
-			player, ok := server.players[name]
+		case req := <-server.chanName:
+			token, reason := "", ""
+			if req.session != "" {
+				// RESUME, the session stands for the credentials
+				if req.name = server.resumeSession(req.session); req.name == "" {
+					reason = "invalid session"
+				}
+			} else {
+				_, online := server.conns[req.name]
+				token, reason = server.accounts.authenticate(req, online)
+			}
+			if reason != "" {
+				server.chanPlayer <- helloResponse{reason: reason}
+				continue
+			}
+			player, ok := server.players[req.name]
 			if !ok {
 				// a new player
-				player = server.newPlayer(name)
+				player = server.newPlayer(req.name)
 			}
-			server.chanPlayer <- player
+			resp := helloResponse{player: player, token: token, session: server.openSession(req.name)}
+			if pc, online := server.conns[req.name]; online {
+				// the new connection takes over
+				resp.taken = &pc
+			}
+			req.pc.name = req.name
+			server.conns[req.name] = req.pc
+			server.sessionOnline(req.name, true)
+			server.chanPlayer <- resp
+
+		case name := <-server.chanSaltReq:
+			server.chanSaltResp <- server.accounts.salt(name)
 
 		case req := <-server.chanGameReq:
 			game, ok := server.games[req.gameID]
 			if req.newGame && !ok {
 				// create a new game
-				game = server.newGame(req.gameID, req.name)
+				game = server.newGame(req.gameID, req.name, req.rules)
 				server.chanGameResp <- game.mailbox
 			} else if !req.newGame && ok {
 				// join an existing game
@@ -97,18 +260,62 @@ loop:
 			player := server.players[req]
 			server.chanPlayerResp <- player.mailbox
 
+		case req := <-server.chanChatReq:
+			if player, ok := server.players[req]; ok {
+				server.chanChatResp <- player.chat
+			} else {
+				server.chanChatResp <- nil
+			}
+
 		case gameID := <-server.chanGameExit:
 			delete(server.games, gameID)
+			server.unlist(gameID)
+			// the corpora the game used may go now
+			server.library.serve(libraryRequest{op: "release", holder: "game:" + gameID})
 			server.chanGameExitResp <- true
 
+		case req := <-server.chanLibraryReq:
+			req.reply <- server.library.serve(req)
+
+		case req := <-server.chanLobbyReq:
+			server.serveLobby(req)
+
 		case name := <-server.chanPlayerExit:
 			delete(server.players, name)
 
+		case pc := <-server.chanOnline:
+			if server.conns[pc.name].conn == pc.conn {
+				// the player may already be back on a new connection
+				delete(server.conns, pc.name)
+				server.sessionOnline(pc.name, false)
+				// like spectators, lobby watchers stop watching
+				delete(server.lobbyWatchers, pc.name)
+			}
+
+		case <-server.chanAdminReq:
+			snapshot := adminSnapshot{
+				games: make(map[string]*Game, len(server.games)),
+				conns: make(map[string]net.Conn, len(server.conns)),
+			}
+			for gameID, game := range server.games {
+				snapshot.games[gameID] = game
+			}
+			for name, pc := range server.conns {
+				snapshot.conns[name] = pc.conn
+			}
+			server.chanAdminResp <- snapshot
+
 		case <-server.chanShutdown:
 			break loop
 		}
 	}
-	(*server.listener).Close()
+	close(server.stopping)
+	for _, listener := range server.listeners {
+		listener.Close()
+	}
+	if server.adminListener != nil {
+		server.adminListener.Close()
+	}
 	for _, game := range server.games {
 		game.exit <- true
 		<-game.exit
@@ -119,46 +326,83 @@ loop:
 
 // Close shuts down the game server from another routine
 func (server *GameServer) Close() (err error) {
-	server.chanShutdown <- true
-	<-server.chanShutdown
+	select {
+	case server.chanShutdown <- true:
+		<-server.chanShutdown
+	case <-server.done:
+		// Run has already returned, e.g. because it could not listen
+	}
 	return nil
 }
 
+// Addrs waits until Run has bound its listeners and returns their actual
+// addresses, which differ from the configured ones when port 0 is used.
+// It returns nil if the server failed to listen.
+func (server *GameServer) Addrs() []net.Addr {
+	<-server.ready
+	addrs := make([]net.Addr, 0, len(server.listeners))
+	for _, listener := range server.listeners {
+		addrs = append(addrs, listener.Addr())
+	}
+	return addrs
+}
+
 // called by GameServer to initiate a new player
 func (server *GameServer) newPlayer(name string) *Player {
 	player := Player{
-		name:    name,
-		gameIDs: make(map[string]chan map[string]string),
-		mailbox: make(chan map[string]string),
-		server:  server}
+		name:     name,
+		gameIDs:  make(map[string]chan map[string]string),
+		watching: make(map[string]chan map[string]string),
+		muted:    make(map[string]bool),
+		mailbox:  make(chan map[string]string),
+		chat:     make(chan map[string]string, CHAT_BACKLOG),
+		lobby:    make(chan map[string]string, LOBBY_BACKLOG),
+		server:   server}
 	server.players[name] = &player
 	return &player
 }
 
 // called by GameServer to initiate a new game
-func (server *GameServer) newGame(gameID string, leader string) *Game {
-	game := Game{
+func (server *GameServer) newGame(gameID string, leader string, rules gameRules) *Game {
+	game := server.allocGame(gameID, leader, rules)
+	player := server.players[leader]
+	game.names[leader] = player.mailbox
+	game.namesOrd[leader] = 0
+	server.games[gameID] = game
+	os.Mkdir(game.directory, os.ModePerm)
+	game.openJournal()
+	game.record("create", map[string]string{"leader": leader, "rules": strings.Join(rules.args(), " ")})
+	go game.routine()
+	return game
+}
+
+// allocate the state of a game, shared by newGame and recoverGames
+func (server *GameServer) allocGame(gameID string, leader string, rules gameRules) *Game {
+	return &Game{
 		gameID:       gameID,
 		state:        WAITING,
+		rules:        rules,
 		leader:       leader,
 		names:        make(map[string]chan map[string]string),
 		namesDisconn: make(map[string]chan map[string]string),
 		namesBye:     make(map[string]chan map[string]string),
 		namesOrd:     make(map[string]int),
+		spectators:   make(map[string]chan map[string]string),
+		chatBacklog:  make(map[string][]map[string]string),
+		disconnSince: make(map[string]time.Time),
+		expired:      make(chan string),
 		usedWords:    make(map[string]bool),
 		wordDict:     make(map[string]int),
 		mailbox:      make(chan map[string]string),
 		exit:         make(chan bool),
-		guessResults: make(map[string]int),
+		guessResults: make(map[string][]int),
+		scores:       make(map[string]int),
 		directory:    server.directory + gameID + "/",
-		server:       server}
-	player := server.players[leader]
-	game.names[leader] = player.mailbox
-	game.namesOrd[leader] = 0
-	server.games[gameID] = &game
-	os.Mkdir(game.directory, os.ModePerm)
-	go game.routine()
-	return &game
+		server:       server,
+
+		done:           make(chan bool),
+		chanStatus:     make(chan chan gameStatus),
+		chanAdminClose: make(chan bool)}
 }
 
 // Server defines the minimum contract our
@@ -166,51 +410,92 @@ func (server *GameServer) newGame(gameID string, leader string) *Game {
 type Server interface {
 	Run() error
 	Close() error
+	Addrs() []net.Addr
+	ListenAdmin(addr string) (net.Addr, error)
+	SetSessionTimeout(timeout time.Duration)
 }
 
 // NewServer creates a new Server using given protocol
-// and addr.
+// and addr. addr may list several comma separated addresses,
+// see parseAddrs.
 func NewServer(protocol, addr string, directory string) (Server, error) {
-	if strings.ToLower(protocol) != RunningProtocol {
+	protocol = strings.ToLower(protocol)
+	if protocol != RunningProtocol && protocol != UnixProtocol {
 		return nil, errors.New("invalid protocol given")
 	}
+	addrs, err := parseAddrs(protocol, addr)
+	if err != nil {
+		return nil, err
+	}
 
-	err := os.MkdirAll(directory, os.ModePerm)
+	err = os.MkdirAll(directory, os.ModePerm)
 	if err != nil {
 		return nil, errors.New("unable to create directories for the given path")
 	}
-	return &GameServer{
-		addr:       addr,
-		players:    make(map[string]*Player),
-		games:      make(map[string]*Game),
-		chanName:   make(chan string),
-		chanPlayer: make(chan *Player),
-		chanGameReq: make(chan struct {
-			gameID  string
-			name    string
-			newGame bool
-		}),
+	server := &GameServer{
+		addrs:            addrs,
+		players:          make(map[string]*Player),
+		conns:            make(map[string]playerConn),
+		games:            make(map[string]*Game),
+		chanName:         make(chan helloRequest),
+		chanPlayer:       make(chan helloResponse),
+		chanSaltReq:      make(chan string),
+		chanSaltResp:     make(chan string),
+		chanGameReq:      make(chan gameRequest),
 		chanGameResp:     make(chan chan map[string]string),
 		chanPlayerReq:    make(chan string),
 		chanPlayerResp:   make(chan chan map[string]string),
+		chanChatReq:      make(chan string),
+		chanChatResp:     make(chan chan map[string]string),
 		chanGameExit:     make(chan string),
 		chanGameExitResp: make(chan bool),
 		chanPlayerExit:   make(chan string),
+		chanLibraryReq:   make(chan libraryRequest),
+		chanLobbyReq:     make(chan lobbyRequest),
+		chanOnline:       make(chan playerConn),
+		chanAdminReq:     make(chan bool),
+		chanAdminResp:    make(chan adminSnapshot),
 		chanShutdown:     make(chan bool),
 		directory:        directory,
-	}, nil
+		ready:            make(chan bool),
+		done:             make(chan bool),
+		stopping:         make(chan bool),
+		library:          openLibrary(directory),
+		accounts:         openAccounts(directory),
+		sessions:         make(map[string]*session),
+		lobby:            make(map[string]lobbyEntry),
+		lobbyWatchers:    make(map[string]chan map[string]string),
+		sessionTimeout:   time.Duration(SESSION_TIMEOUT) * time.Second,
+	}
+	// rebuild the games that were running when the server stopped
+	if err := server.recoverGames(); err != nil {
+		return nil, err
+	}
+	return server, nil
 }
 
 func main() {
-	addrPtr := flag.String("port", ServerAddress, "Listening address for the game server")
+	addrPtr := flag.String("port", ServerAddress, "Comma separated listening addresses for the game server, e.g. localhost:9999,unix:/tmp/wordcount.sock")
+	adminPtr := flag.String("admin", "", "Address of the admin socket, e.g. unix:/tmp/wordcount-admin.sock, none if empty")
+	sessionPtr := flag.Int("session", SESSION_TIMEOUT, "Seconds a disconnected player keeps its session and its seats, 0 for ever")
 	flag.Parse()
 
 	// Start the new server
 	gameServer, err := NewServer(RunningProtocol, *addrPtr, RootDir+"/"+StorageDirectoryName)
 	if err != nil {
-		log.Println("error starting the game server")
-		return
+		log.Println("error starting the game server:", err)
+		os.Exit(1)
+	}
+	gameServer.SetSessionTimeout(time.Duration(*sessionPtr) * time.Second)
+	if *adminPtr != "" {
+		if _, err := gameServer.ListenAdmin(*adminPtr); err != nil {
+			log.Println("error starting the admin socket:", err)
+			os.Exit(1)
+		}
 	}
 	// Run the servers
-	gameServer.Run()
+	if err := gameServer.Run(); err != nil {
+		log.Println("error running the game server:", err)
+		os.Exit(1)
+	}
 }
@@ -1,7 +1,16 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"net"
@@ -37,13 +46,14 @@ type TestServer struct {
 	protocol   string
 	addr       string
 	gameServer Server
+	directory  string // storage directory, removed by the test
 }
 
 func NewTestServer(t *testing.T) *TestServer {
 	rand.Seed(time.Now().UnixNano())
-	// Start the new server
-	os.RemoveAll(RootDir + StorageDirectoryName)
-	gameServer, err := NewServer(RunningProtocol, ServerAddress, RootDir+StorageDirectoryName)
+	// Start the new server, storage goes away with the test
+	directory := t.TempDir() + "/" + StorageDirectoryName
+	gameServer, err := NewServer(RunningProtocol, ServerAddress, directory)
 	if err != nil || gameServer == nil {
 		t.Fatalf("Error in server creation: %v", err.Error())
 	}
@@ -52,11 +62,27 @@ func NewTestServer(t *testing.T) *TestServer {
 		gameServer.Run()
 	}()
 	randSleep()
-	return &TestServer{RunningProtocol, ServerAddress, gameServer}
+	return &TestServer{RunningProtocol, ServerAddress, gameServer, directory}
+}
+
+// NewTestServerAt runs a server on a free port with the given storage directory.
+func NewTestServerAt(t *testing.T, directory string) *TestServer {
+	gameServer, err := NewServer(RunningProtocol, "localhost:0", directory)
+	if err != nil || gameServer == nil {
+		t.Fatalf("Error in server creation: %v", err)
+	}
+	go func() {
+		gameServer.Run()
+	}()
+	addrs := gameServer.Addrs()
+	if len(addrs) == 0 {
+		t.Fatalf("Error in server creation: not listening")
+	}
+	return &TestServer{RunningProtocol, addrs[0].String(), gameServer, directory}
 }
 
 func (tg *TestServer) CleanUp(t *testing.T) {
-	err := os.RemoveAll(RootDir + StorageDirectoryName)
+	err := os.RemoveAll(tg.directory)
 	if err != nil {
 		t.Fatalf("Error in storage deletion: %v", err.Error())
 	}
@@ -71,9 +97,34 @@ func (ts *TestServer) Connect(t *testing.T) net.Conn {
 	return conn
 }
 
+// WaitDisconnected waits until the game has seen the player go. Nobody is
+// told, so the game is asked like the admin socket does.
+func (ts *TestServer) WaitDisconnected(t *testing.T, gameID string, name string) {
+	server := ts.gameServer.(*GameServer)
+	for i := 0; i < 100; i++ {
+		snapshot, ok := server.adminSnapshot()
+		if !ok {
+			t.Fatalf("Server stopped while waiting for %s to disconnect", name)
+		}
+		for _, status := range gameStatuses(snapshot) {
+			if status.gameID != gameID {
+				continue
+			}
+			for _, disconnected := range status.disconnected {
+				if disconnected == name {
+					return
+				}
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Game %s did not see %s disconnect", gameID, name)
+}
+
 type TestPlayer struct {
-	name string
-	conn net.Conn
+	name    string
+	conn    net.Conn
+	pending []string // lines received but not yet read
 }
 
 func NewPlayer(t *testing.T, ts *TestServer, i int) *TestPlayer {
@@ -128,6 +179,14 @@ func (tp *TestPlayer) SendJoinGame(t *testing.T, tag string) {
 	}
 }
 
+func (tp *TestPlayer) SendWatchGame(t *testing.T, tag string) {
+	payload := "WATCH_GAME " + tag + "\n"
+	_, err := tp.conn.Write([]byte(payload))
+	if err != nil {
+		t.Fatalf("Error in write: %v", err.Error())
+	}
+}
+
 func (tp *TestPlayer) SendStartGame(t *testing.T, tag string) {
 	payload := "START_GAME " + tag + "\n"
 	_, err := tp.conn.Write([]byte(payload))
@@ -199,6 +258,37 @@ func (tp *TestPlayer) ReadResponse(t *testing.T) string {
 	return strings.TrimSpace(string(out[:n]))
 }
 
+func (tp *TestPlayer) SendJSON(t *testing.T, cmd map[string]interface{}) {
+	payload, err := json.Marshal(cmd)
+	if err != nil {
+		t.Fatalf("Error in marshal: %v", err.Error())
+	}
+	_, err = tp.conn.Write(append(payload, '\n'))
+	if err != nil {
+		t.Fatalf("Error in write: %v", err.Error())
+	}
+}
+
+// ReadLine returns one line of the response, for messages that may or may
+// not arrive in the same read.
+func (tp *TestPlayer) ReadLine(t *testing.T) string {
+	if len(tp.pending) == 0 {
+		tp.pending = strings.Split(tp.ReadResponse(t), "\n")
+	}
+	line := tp.pending[0]
+	tp.pending = tp.pending[1:]
+	return line
+}
+
+func (tp *TestPlayer) ReadJSON(t *testing.T) map[string]interface{} {
+	resp := tp.ReadLine(t)
+	msg := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(resp), &msg); err != nil {
+		t.Fatalf("Error in unmarshal of %q: %v", resp, err.Error())
+	}
+	return msg
+}
+
 type TestGame struct {
 	playerCount int
 	players     []*TestPlayer
@@ -237,6 +327,23 @@ func (tg *TestGame) GetFileSize(t *testing.T) {
 	tg.fileSize = f.Size()
 }
 
+// CountWord counts a word of the test file the way the server does
+func (tg *TestGame) CountWord(t *testing.T, word string) int {
+	contents, err := ioutil.ReadFile(tg.fileName)
+	if err != nil {
+		t.Fatalf("Error in reading %s: %v", tg.fileName, err.Error())
+	}
+	count := 0
+	for _, line := range strings.Split(string(contents), "\n") {
+		for _, w := range strings.Fields(line) {
+			if w == word {
+				count++
+			}
+		}
+	}
+	return count
+}
+
 func (tg *TestGame) GameSetup(t *testing.T) {
 	for i := 0; i < tg.playerCount; i++ {
 		time.Sleep(10 * time.Millisecond)
@@ -323,6 +430,30 @@ func (tg *TestGame) JoinGame(t *testing.T) {
 	}
 }
 
+// OpenGame creates a game with the given rules, led by the first player,
+// lets the other players join and waits until the leader is told the game
+// is ready. The rules must let every player in.
+func (tg *TestGame) OpenGame(t *testing.T, rules string) {
+	leader := tg.players[0]
+	tg.tag = randSeq(6)
+	leader.SendNewGame(t, tg.tag+" "+rules)
+	resp := leader.ReadResponse(t)
+	if resp != fmt.Sprintf("Game %s created! You are the leader of the game. Waiting for players to join.", tg.tag) {
+		t.Fatalf("Incorrect response in OpenGame: %s", resp)
+	}
+	for _, player := range tg.players[1:] {
+		player.SendJoinGame(t, tg.tag)
+		resp = player.ReadResponse(t)
+		if !strings.HasPrefix(resp, fmt.Sprintf("Joined Game %s.", tg.tag)) {
+			t.Fatalf("Incorrect response in OpenGame JOIN_GAME: %s", resp)
+		}
+	}
+	resp = leader.ReadResponse(t)
+	if resp != fmt.Sprintf("Game %s is ready to start.", tg.tag) {
+		t.Fatalf("Incorrect response in OpenGame ready: %s", resp)
+	}
+}
+
 func (tg *TestGame) StartGame(t *testing.T) {
 	leader := tg.players[0]
 	leader.SendStartGame(t, tg.tag)
@@ -983,7 +1114,7 @@ func TestFinal_Goodbye(t *testing.T) {
 		}
 	}
 
-	os.MkdirAll(RootDir+StorageDirectoryName, os.ModePerm) // Recreate directory
+	os.MkdirAll(testGame.server.directory, os.ModePerm) // Recreate directory
 	leader.SendJoinGame(t, testGame.tag)
 	resp = leader.ReadResponse(t)
 	expectedResponse = fmt.Sprintf("Game %s doesn't exist! Please enter correct tag or create a new game.", testGame.tag)
@@ -1034,3 +1165,1809 @@ func TestFinal_Goodbye(t *testing.T) {
 
 	testGame.server.CleanUp(t)
 }
+
+func TestFinal_JSONProtocol(t *testing.T) {
+	testGame := NewTestGame(t, 4)
+	leader := NewPlayer(t, testGame.server, 0)
+	testGame.players = append(testGame.players, leader)
+
+	leader.SendJSON(t, map[string]interface{}{"cmd": "HELLO", "name": leader.name})
+	msg := leader.ReadJSON(t)
+	if msg["type"] != "response" || msg["event"] != "WELCOME" || msg["name"] != leader.name {
+		t.Fatalf("Incorrect JSON response to HELLO: %v", msg)
+	}
+
+	leader.SendJSON(t, map[string]interface{}{"cmd": "NEW_GAME"})
+	msg = leader.ReadJSON(t)
+	if msg["type"] != "error" || msg["event"] != "INVALID_ARGS" || msg["cmd"] != "NEW_GAME" {
+		t.Fatalf("Incorrect JSON response to NEW_GAME without tag: %v", msg)
+	}
+
+	leader.conn.Write([]byte("NEW_GAME abc\n"))
+	msg = leader.ReadJSON(t)
+	if msg["event"] != "INVALID_JSON" {
+		t.Fatalf("Incorrect JSON response to a text command: %v", msg)
+	}
+
+	testGame.tag = randSeq(6)
+	leader.SendJSON(t, map[string]interface{}{"cmd": "NEW_GAME", "gameID": testGame.tag})
+	msg = leader.ReadJSON(t)
+	if msg["event"] != "GAME_CREATED" || msg["gameID"] != testGame.tag {
+		t.Fatalf("Incorrect JSON response to NEW_GAME: %v", msg)
+	}
+
+	// text players share the game with the JSON leader
+	for i := 1; i < testGame.playerCount; i++ {
+		player := NewPlayer(t, testGame.server, i)
+		testGame.players = append(testGame.players, player)
+		player.SendHello(t)
+		player.ReadResponse(t)
+		player.SendJoinGame(t, testGame.tag)
+		player.ReadResponse(t)
+	}
+
+	msg = leader.ReadJSON(t)
+	if msg["type"] != "notification" || msg["event"] != "READY" || msg["gameID"] != testGame.tag {
+		t.Fatalf("Incorrect JSON READY notification: %v", msg)
+	}
+
+	leader.SendJSON(t, map[string]interface{}{"cmd": "START_GAME", "gameID": testGame.tag})
+	msg = leader.ReadJSON(t)
+	if msg["event"] != "GAME_STARTED" {
+		t.Fatalf("Incorrect JSON response to START_GAME: %v", msg)
+	}
+	for _, player := range testGame.players[1:] {
+		resp := player.ReadResponse(t)
+		expectedResponse := fmt.Sprintf("Game %v has started. Waiting for %v to upload the file.", testGame.tag, leader.name)
+		if resp != expectedResponse {
+			t.Fatalf("Incorrect text response next to a JSON leader")
+		}
+	}
+
+	leader.SendJSON(t, map[string]interface{}{"cmd": "FILE_UPLOAD", "gameID": testGame.tag, "filename": "words.txt", "data": "alpha beta beta\n"})
+	msg = leader.ReadJSON(t)
+	if msg["event"] != "UPLOAD_ACCEPTED" || msg["filename"] != "words.txt" {
+		t.Fatalf("Incorrect JSON response to FILE_UPLOAD: %v", msg)
+	}
+	msg = leader.ReadJSON(t)
+	if msg["event"] != "UPLOADED" {
+		t.Fatalf("Incorrect JSON UPLOADED notification: %v", msg)
+	}
+
+	testGame.server.CleanUp(t)
+}
+
+func TestFinal_ListenAddrs(t *testing.T) {
+	dir := t.TempDir()
+	socket := dir + "/game.sock"
+	gameServer, err := NewServer(RunningProtocol, "localhost:0,unix:"+socket, dir+"/"+StorageDirectoryName)
+	if err != nil {
+		t.Fatalf("Error in server creation: %v", err.Error())
+	}
+	go gameServer.Run()
+	addrs := gameServer.Addrs()
+	if len(addrs) != 2 || addrs[1].String() != socket {
+		t.Fatalf("Incorrect bound addresses: %v", addrs)
+	}
+	if strings.HasSuffix(addrs[0].String(), ":0") {
+		t.Fatalf("Port 0 was not resolved to the bound port: %v", addrs[0])
+	}
+
+	for i, addr := range addrs {
+		conn, err := net.Dial(addr.Network(), addr.String())
+		if err != nil {
+			t.Fatalf("Error in connection to %v: %v", addr, err.Error())
+		}
+		player := &TestPlayer{name: fmt.Sprintf("Player%d", i), conn: conn}
+		player.SendHello(t)
+		resp := player.ReadResponse(t)
+		expectedResponse := fmt.Sprintf("Welcome to Word Count %s! Do you want to create a new game or join an existing game?", player.name)
+		if resp != expectedResponse {
+			t.Fatalf("Incorrect response to HELLO on %v", addr)
+		}
+		player.Close()
+	}
+
+	// a second server on the same address reports the listen error
+	busy, err := NewServer(RunningProtocol, addrs[0].String(), dir+"/"+StorageDirectoryName)
+	if err != nil {
+		t.Fatalf("Error in server creation: %v", err.Error())
+	}
+	if err := busy.Run(); err == nil {
+		t.Fatalf("Run on a busy address did not fail")
+	}
+	busy.Close()
+	gameServer.Close()
+}
+
+func TestFinal_Recovery(t *testing.T) {
+	directory := t.TempDir() + "/"
+	testGame := &TestGame{
+		players:     make([]*TestPlayer, 0),
+		server:      NewTestServerAt(t, directory),
+		playerCount: MIN_PLAYERS,
+		fileName:    "test.txt",
+	}
+	testGame.GameSetup(t)
+	testGame.NewGame(t)
+	testGame.JoinGame(t)
+	testGame.StartGame(t)
+	testGame.GetFileSize(t)
+
+	leader := testGame.players[0]
+	leader.SendFileUpload(t, testGame.tag, testGame.fileName, testGame.fileSize)
+	pickerResponse := fmt.Sprintf("Upload completed! Please select a word from %s.", testGame.fileName)
+	for _, p := range testGame.players {
+		if p.ReadResponse(t) == pickerResponse {
+			testGame.picker = p
+		}
+	}
+	if testGame.picker == nil {
+		t.Fatalf("No picker after FILE_UPLOAD")
+	}
+	testGame.picker.SendRandomWord(t, testGame.tag, "thy")
+	for _, p := range testGame.players {
+		if p.ReadResponse(t) != "Word selected is thy! Guess the word count." {
+			t.Fatalf("Incorrect response to RANDOM_WORD selection")
+		}
+	}
+	// one guess is recorded before the server goes down
+	leader.SendGuessCount(t, testGame.tag, 1)
+	// text clients are not told the guess was recorded, the answer to
+	// SCORES comes after it
+	leader.conn.Write([]byte(fmt.Sprintf("SCORES %s\n", testGame.tag)))
+	if resp := leader.ReadResponse(t); resp != fmt.Sprintf("No rounds have been played in game %s yet.", testGame.tag) {
+		t.Fatalf("Incorrect response to SCORES: %s", resp)
+	}
+	testGame.server.gameServer.Close()
+	for _, p := range testGame.players {
+		p.Close()
+	}
+
+	testGame.server = NewTestServerAt(t, directory)
+	for _, p := range testGame.players {
+		p.conn = testGame.server.Connect(t)
+		p.SendHello(t)
+		resp := p.ReadResponse(t)
+		expectedResponse := fmt.Sprintf("Welcome to Word Count %s! Resumed Game %s. Current state is RUNNING.", p.name, testGame.tag)
+		if resp != expectedResponse {
+			t.Fatalf("Incorrect response to HELLO after recovery: %s", resp)
+		}
+	}
+	for _, p := range testGame.players[1:] {
+		p.SendGuessCount(t, testGame.tag, 2)
+	}
+	winnerCount := 0
+	for _, p := range testGame.players {
+		resp := p.ReadResponse(t)
+		if resp == "Congratulations you are the winner!" {
+			winnerCount++
+		} else if resp != "Sorry you lose! Better luck next time." {
+			t.Fatalf("Incorrect response to WORD_COUNT after recovery: %s", resp)
+		}
+	}
+	if winnerCount != 1 {
+		t.Fatalf("Incorrect count of winners after recovery")
+	}
+	testGame.server.gameServer.Close()
+}
+
+func TestFinal_Rules(t *testing.T) {
+	testGame := NewTestGame(t, 3)
+	testGame.GameSetup(t)
+	leader := testGame.players[0]
+	testGame.tag = randSeq(6)
+
+	leader.SendNewGame(t, testGame.tag+" min=1")
+	resp := leader.ReadResponse(t)
+	if resp != "Invalid game rules: min must be at least 2." {
+		t.Fatalf("Incorrect response to NEW_GAME with invalid rules: %s", resp)
+	}
+
+	leader.SendNewGame(t, testGame.tag+" min=2 max=3 rounds=1 timeout=1 leaderGuess=no")
+	resp = leader.ReadResponse(t)
+	expectedResponse := fmt.Sprintf("Game %s created! You are the leader of the game. Waiting for players to join.", testGame.tag)
+	if resp != expectedResponse {
+		t.Fatalf("Incorrect response to NEW_GAME with rules")
+	}
+	rules := "Rules: 2-3 players, 1 round, 120s to pick, 1s to guess, the leader does not guess."
+	for j, state := range []string{"READY", "FULL"} {
+		player := testGame.players[j+1]
+		player.SendJoinGame(t, testGame.tag)
+		resp = player.ReadResponse(t)
+		expectedResponse = fmt.Sprintf("Joined Game %s. Current state is %s. %s", testGame.tag, state, rules)
+		if resp != expectedResponse {
+			t.Fatalf("Incorrect response to JOIN_GAME with rules: %s", resp)
+		}
+		if j == 0 {
+			resp = leader.ReadResponse(t)
+			if resp != fmt.Sprintf("Game %s is ready to start.", testGame.tag) {
+				t.Fatalf("Incorrect READY with min=2: %s", resp)
+			}
+		}
+	}
+	testGame.StartGame(t)
+	testGame.GetFileSize(t)
+	leader.SendFileUpload(t, testGame.tag, testGame.fileName, testGame.fileSize)
+	pickerResponse := fmt.Sprintf("Upload completed! Please select a word from %s.", testGame.fileName)
+	for _, p := range testGame.players {
+		if p.ReadResponse(t) == pickerResponse {
+			testGame.picker = p
+		}
+	}
+	testGame.picker.SendRandomWord(t, testGame.tag, "thy")
+	for _, p := range testGame.players {
+		p.ReadResponse(t)
+	}
+
+	leader.SendGuessCount(t, testGame.tag, 1)
+	resp = leader.ReadResponse(t)
+	if resp != fmt.Sprintf("The leader does not guess in game %s.", testGame.tag) {
+		t.Fatalf("Incorrect response to WORD_COUNT by the leader: %s", resp)
+	}
+	// only one player guesses, the timeout closes the round
+	testGame.picker.SendGuessCount(t, testGame.tag, 1)
+	resp = testGame.picker.ReadLine(t)
+	if resp != fmt.Sprintf("Time is up for guesses in game %s.", testGame.tag) {
+		t.Fatalf("Incorrect TIMEOUT after the guess timeout: %s", resp)
+	}
+	resp = testGame.picker.ReadLine(t)
+	if resp != "Congratulations you are the winner!" {
+		t.Fatalf("Incorrect response after the guess timeout: %s", resp)
+	}
+	leader.ReadLine(t)
+	leader.ReadLine(t)
+	resp = leader.ReadLine(t)
+	if resp != fmt.Sprintf("Game %s complete. All rounds have been played, please close the game.", testGame.tag) {
+		t.Fatalf("Incorrect response to leader after the last round: %s", resp)
+	}
+	leader.SendRestart(t, testGame.tag)
+	resp = leader.ReadResponse(t)
+	if resp != fmt.Sprintf("Game %s has no rounds left. Please close the game.", testGame.tag) {
+		t.Fatalf("Incorrect response to RESTART after the last round: %s", resp)
+	}
+
+	testGame.server.CleanUp(t)
+}
+
+func TestFinal_PickTimeout(t *testing.T) {
+	testGame := NewTestGame(t, 3)
+	testGame.GameSetup(t)
+	leader := testGame.players[0]
+	testGame.OpenGame(t, "min=3 max=3 pickTimeout=1")
+	testGame.StartGame(t)
+	testGame.GetFileSize(t)
+	leader.SendFileUpload(t, testGame.tag, testGame.fileName, testGame.fileSize)
+	pickerResponse := fmt.Sprintf("Upload completed! Please select a word from %s.", testGame.fileName)
+	var late *TestPlayer
+	for _, p := range testGame.players {
+		if p.ReadLine(t) == pickerResponse {
+			late = p
+		}
+	}
+
+	// the picker lets the deadline pass
+	for _, p := range testGame.players {
+		if p != leader && p != late {
+			testGame.picker = p
+		}
+	}
+	expectedResponse := fmt.Sprintf("Time is up for %s to pick a word in game %s. %s picks instead.", late.name, testGame.tag, testGame.picker.name)
+	for _, p := range testGame.players {
+		resp := p.ReadLine(t)
+		if resp != expectedResponse {
+			t.Fatalf("Incorrect TIMEOUT after the pick timeout: %s", resp)
+		}
+	}
+	resp := testGame.picker.ReadLine(t)
+	if resp != pickerResponse {
+		t.Fatalf("Incorrect response to the new picker: %s", resp)
+	}
+	late.SendRandomWord(t, testGame.tag, "thy")
+	resp = late.ReadLine(t)
+	if resp != fmt.Sprintf("Only the picker can pick the word. Please contact %s.", testGame.picker.name) {
+		t.Fatalf("Incorrect response to RANDOM_WORD by the late picker: %s", resp)
+	}
+
+	testGame.server.CleanUp(t)
+}
+
+func TestFinal_Scores(t *testing.T) {
+	testGame := NewTestGame(t, 3)
+	testGame.GameSetup(t)
+	leader := testGame.players[0]
+	testGame.OpenGame(t, "min=3 max=3 rounds=2")
+
+	// names end up in the lists of winners and standings
+	stranger := NewEmptyPlayer(t, testGame.server)
+	for _, name := range []string{"a,b", "x:1", "a b"} {
+		stranger.SendJSON(t, map[string]interface{}{"cmd": "HELLO", "name": name})
+		msg := stranger.ReadJSON(t)
+		if msg["event"] != "INVALID_USERNAME" {
+			t.Fatalf("Incorrect response to HELLO %q: %v", name, msg)
+		}
+	}
+	stranger.Close()
+
+	leader.conn.Write([]byte("SCORES\n"))
+	resp := leader.ReadLine(t)
+	if resp != "Invalid arguments for command SCORES." {
+		t.Fatalf("Incorrect response to SCORES without a game: %s", resp)
+	}
+	leader.conn.Write([]byte(fmt.Sprintf("SCORES %s\n", testGame.tag)))
+	resp = leader.ReadLine(t)
+	if resp != fmt.Sprintf("No rounds have been played in game %s yet.", testGame.tag) {
+		t.Fatalf("Incorrect response to SCORES before the first round: %s", resp)
+	}
+
+	testGame.StartGame(t)
+	testGame.GetFileSize(t)
+	leader.SendFileUpload(t, testGame.tag, testGame.fileName, testGame.fileSize)
+	pickerResponse := fmt.Sprintf("Upload completed! Please select a word from %s.", testGame.fileName)
+	for _, p := range testGame.players {
+		if p.ReadLine(t) == pickerResponse {
+			testGame.picker = p
+		}
+	}
+	testGame.picker.SendRandomWord(t, testGame.tag, "thy")
+	for _, p := range testGame.players {
+		p.ReadLine(t)
+	}
+
+	// the picker guesses exactly, everybody else is off by the whole count
+	actual := testGame.CountWord(t, "thy")
+	standings := []string{fmt.Sprintf("%s %d", testGame.picker.name, MAX_POINTS+EXACT_BONUS)}
+	for _, p := range testGame.players {
+		if p != testGame.picker {
+			p.SendGuessCount(t, testGame.tag, int64(2*actual))
+			standings = append(standings, p.name+" 0")
+		}
+	}
+	testGame.picker.SendGuessCount(t, testGame.tag, int64(actual))
+	expectedStandings := fmt.Sprintf("Standings after round 1: %s.", strings.Join(standings, ", "))
+	for _, p := range testGame.players {
+		resp = p.ReadLine(t)
+		if p == testGame.picker && resp != "Congratulations you are the winner!" {
+			t.Fatalf("Incorrect response to the winner: %s", resp)
+		}
+		resp = p.ReadLine(t)
+		if resp != expectedStandings {
+			t.Fatalf("Incorrect standings after the first round: %s", resp)
+		}
+	}
+	resp = leader.ReadLine(t)
+	if resp != fmt.Sprintf("Game %s complete. Do you want to restart or close the game?", testGame.tag) {
+		t.Fatalf("Incorrect response to leader after the first round: %s", resp)
+	}
+	resp = leader.ReadLine(t)
+	if resp != expectedStandings {
+		t.Fatalf("Incorrect standings in the restart prompt: %s", resp)
+	}
+
+	testGame.players[1].conn.Write([]byte(fmt.Sprintf("SCORES %s\n", testGame.tag)))
+	resp = testGame.players[1].ReadLine(t)
+	expectedResponse := fmt.Sprintf("Scores for game %s after round 1: %s.", testGame.tag, strings.Join(standings, ", "))
+	if resp != expectedResponse {
+		t.Fatalf("Incorrect response to SCORES after the first round: %s", resp)
+	}
+
+	testGame.server.CleanUp(t)
+}
+
+func TestFinal_Ties(t *testing.T) {
+	testGame := NewTestGame(t, 3)
+	testGame.GameSetup(t)
+	leader := testGame.players[0]
+	testGame.tag = randSeq(6)
+
+	leader.SendNewGame(t, testGame.tag+" ties=some")
+	resp := leader.ReadResponse(t)
+	if resp != "Invalid game rules: invalid value some for rule ties." {
+		t.Fatalf("Incorrect response to NEW_GAME with an invalid tie policy: %s", resp)
+	}
+	testGame.OpenGame(t, "min=3 max=3 ties=shared")
+	testGame.StartGame(t)
+	testGame.GetFileSize(t)
+	leader.SendFileUpload(t, testGame.tag, testGame.fileName, testGame.fileSize)
+	pickerResponse := fmt.Sprintf("Upload completed! Please select a word from %s.", testGame.fileName)
+	for _, p := range testGame.players {
+		if p.ReadLine(t) == pickerResponse {
+			testGame.picker = p
+		}
+	}
+	testGame.picker.SendRandomWord(t, testGame.tag, "thy")
+	for _, p := range testGame.players {
+		p.ReadLine(t)
+	}
+
+	// the leader and the other player are equally close
+	actual := testGame.CountWord(t, "thy")
+	var other *TestPlayer
+	for _, p := range testGame.players[1:] {
+		if p != testGame.picker {
+			other = p
+		}
+	}
+	leader.SendGuessCount(t, testGame.tag, int64(actual+1))
+	other.SendGuessCount(t, testGame.tag, int64(actual-1))
+	testGame.picker.SendGuessCount(t, testGame.tag, int64(2*actual))
+
+	resp = leader.ReadLine(t)
+	if resp != fmt.Sprintf("Congratulations you share the win with %s!", other.name) {
+		t.Fatalf("Incorrect response to the leader after a shared win: %s", resp)
+	}
+	resp = other.ReadLine(t)
+	if resp != fmt.Sprintf("Congratulations you share the win with %s!", leader.name) {
+		t.Fatalf("Incorrect response to the player after a shared win: %s", resp)
+	}
+	resp = testGame.picker.ReadLine(t)
+	if resp != "Sorry you lose! Better luck next time." {
+		t.Fatalf("Incorrect response to the loser after a shared win: %s", resp)
+	}
+
+	testGame.server.CleanUp(t)
+}
+
+func TestFinal_Spectator(t *testing.T) {
+	testGame := NewTestGame(t, 3)
+	testGame.GameSetup(t)
+	leader := testGame.players[0]
+	player := testGame.players[1]
+	spectator := testGame.players[2]
+	testGame.tag = randSeq(6)
+	leader.SendNewGame(t, testGame.tag+" min=2 max=2")
+	leader.ReadResponse(t)
+	player.SendJoinGame(t, testGame.tag)
+	player.ReadResponse(t)
+	leader.ReadResponse(t)
+
+	spectator.SendWatchGame(t, testGame.tag)
+	resp := spectator.ReadLine(t)
+	if resp != fmt.Sprintf("Watching Game %s. Current state is FULL.", testGame.tag) {
+		t.Fatalf("Incorrect response to WATCH_GAME: %s", resp)
+	}
+	player.SendWatchGame(t, testGame.tag)
+	resp = player.ReadLine(t)
+	if resp != fmt.Sprintf("You already play in game %s.", testGame.tag) {
+		t.Fatalf("Incorrect response to WATCH_GAME by a player: %s", resp)
+	}
+
+	leader.SendStartGame(t, testGame.tag)
+	leader.ReadLine(t)
+	player.ReadLine(t)
+	resp = spectator.ReadLine(t)
+	if resp != fmt.Sprintf("Game %s has started. Waiting for %s to upload the file.", testGame.tag, leader.name) {
+		t.Fatalf("Incorrect STARTED to the spectator: %s", resp)
+	}
+	testGame.GetFileSize(t)
+	leader.SendFileUpload(t, testGame.tag, testGame.fileName, testGame.fileSize)
+	leader.ReadLine(t)
+	player.ReadLine(t)
+	resp = spectator.ReadLine(t)
+	if resp != "Upload completed! Waiting for word selection." {
+		t.Fatalf("Incorrect UPLOADED to the spectator: %s", resp)
+	}
+	player.SendRandomWord(t, testGame.tag, "thy")
+	leader.ReadLine(t)
+	player.ReadLine(t)
+	resp = spectator.ReadLine(t)
+	if resp != "Word selected is thy! Waiting for the guesses." {
+		t.Fatalf("Incorrect WORD_SELECTED to the spectator: %s", resp)
+	}
+	spectator.SendGuessCount(t, testGame.tag, 1)
+	resp = spectator.ReadLine(t)
+	if resp != "Error! Please send a valid command." {
+		t.Fatalf("Incorrect response to WORD_COUNT by the spectator: %s", resp)
+	}
+
+	actual := testGame.CountWord(t, "thy")
+	leader.SendGuessCount(t, testGame.tag, int64(actual))
+	player.SendGuessCount(t, testGame.tag, int64(2*actual))
+	resp = spectator.ReadLine(t)
+	if resp != fmt.Sprintf("Round over! The winner is %s.", leader.name) {
+		t.Fatalf("Incorrect WINNER to the spectator: %s", resp)
+	}
+	player.ReadLine(t)
+	leader.ReadLine(t)
+	leader.ReadLine(t)
+
+	// the seat of a leaving player goes to the spectator on restart
+	player.SendGoodbye(t)
+	player.ReadLine(t)
+	leader.SendRestart(t, testGame.tag)
+	resp = spectator.ReadLine(t)
+	if resp != fmt.Sprintf("A seat opened up! Joined Game %s. Current state is FULL.", testGame.tag) {
+		t.Fatalf("Incorrect promotion of the spectator: %s", resp)
+	}
+	leader.ReadLine(t)
+	resp = leader.ReadLine(t)
+	if resp != fmt.Sprintf("Game %s is ready to start.", testGame.tag) {
+		t.Fatalf("Incorrect READY after the promotion: %s", resp)
+	}
+
+	// a spectator may get a seat while its connection drops
+	guests := make([]*TestPlayer, 0)
+	for i := 0; i < 20; i++ {
+		tag := randSeq(6)
+		host := &TestPlayer{name: "Host" + randSeq(6), conn: testGame.server.Connect(t)}
+		guest := &TestPlayer{name: "Guest" + randSeq(6), conn: testGame.server.Connect(t)}
+		watcher := &TestPlayer{name: "Watcher" + randSeq(6), conn: testGame.server.Connect(t)}
+		for _, p := range []*TestPlayer{host, guest, watcher} {
+			p.SendHello(t)
+			p.ReadLine(t)
+		}
+		host.SendNewGame(t, tag+" min=2 max=2")
+		host.ReadLine(t)
+		guest.SendJoinGame(t, tag)
+		guest.ReadLine(t)
+		host.ReadLine(t)
+		watcher.SendWatchGame(t, tag)
+		watcher.ReadLine(t)
+		watcher.Close()
+		guest.SendGoodbye(t)
+		guest.ReadLine(t)
+		// the game still talks to everyone seated
+		host.conn.Write([]byte(fmt.Sprintf("SAY %s hello\nSCORES %s\n", tag, tag)))
+		for resp = host.ReadLine(t); resp != fmt.Sprintf("No rounds have been played in game %s yet.", tag); resp = host.ReadLine(t) {
+		}
+		host.Close()
+		// the game tells the players that left when it exits
+		guests = append(guests, guest)
+	}
+
+	testGame.server.CleanUp(t)
+	for _, guest := range guests {
+		guest.Close()
+	}
+}
+
+func TestFinal_Chat(t *testing.T) {
+	testGame := NewTestGame(t, 3)
+	testGame.GameSetup(t)
+	leader := testGame.players[0]
+	talker := testGame.players[1]
+	listener := testGame.players[2]
+	testGame.OpenGame(t, "min=3 max=3")
+
+	talker.conn.Write([]byte(fmt.Sprintf("SAY %s hello  everyone\n", testGame.tag)))
+	expected := fmt.Sprintf("[%s] %s: hello  everyone", testGame.tag, talker.name)
+	for _, p := range []*TestPlayer{leader, listener} {
+		resp := p.ReadLine(t)
+		if resp != expected {
+			t.Fatalf("Incorrect CHAT to %s: %s", p.name, resp)
+		}
+	}
+	talker.conn.Write([]byte(fmt.Sprintf("SAY %s %s\n", testGame.tag, strings.Repeat("x", MAX_CHAT_LENGTH+1))))
+	resp := talker.ReadLine(t)
+	if resp != fmt.Sprintf("Message is too long, the limit is %d characters.", MAX_CHAT_LENGTH) {
+		t.Fatalf("Incorrect response to a long SAY: %s", resp)
+	}
+	talker.conn.Write([]byte("WHISPER Nobody hi\n"))
+	resp = talker.ReadLine(t)
+	if resp != "Player Nobody doesn't exist!" {
+		t.Fatalf("Incorrect response to WHISPER to an unknown player: %s", resp)
+	}
+
+	// muted players are skipped, whispers reach only the recipient
+	listener.conn.Write([]byte(fmt.Sprintf("MUTE %s\n", talker.name)))
+	resp = listener.ReadLine(t)
+	if resp != fmt.Sprintf("%s is muted.", talker.name) {
+		t.Fatalf("Incorrect response to MUTE: %s", resp)
+	}
+	talker.conn.Write([]byte(fmt.Sprintf("SAY %s anyone there?\n", testGame.tag)))
+	leader.ReadLine(t)
+	talker.conn.Write([]byte(fmt.Sprintf("WHISPER %s psst\n", listener.name)))
+	leader.conn.Write([]byte(fmt.Sprintf("WHISPER %s welcome\n", listener.name)))
+	resp = listener.ReadLine(t)
+	if resp != fmt.Sprintf("%s whispers: welcome", leader.name) {
+		t.Fatalf("Incorrect WHISPER to the listener: %s", resp)
+	}
+
+	// chat sent while disconnected is delivered on reconnect
+	listener.conn.Write([]byte(fmt.Sprintf("UNMUTE %s\n", talker.name)))
+	listener.ReadLine(t)
+	listener.Close()
+	testGame.server.WaitDisconnected(t, testGame.tag, listener.name)
+	// the leader hears the SAY once the talker is done with the WHISPER
+	talker.conn.Write([]byte(fmt.Sprintf("WHISPER %s come back\n", listener.name)))
+	talker.conn.Write([]byte(fmt.Sprintf("SAY %s see you later\n", testGame.tag)))
+	if resp = leader.ReadLine(t); resp != fmt.Sprintf("[%s] %s: see you later", testGame.tag, talker.name) {
+		t.Fatalf("Incorrect CHAT to the leader: %s", resp)
+	}
+	listener.conn = testGame.server.Connect(t)
+	listener.pending = nil
+	listener.SendHello(t)
+	listener.ReadLine(t)
+	received := map[string]bool{listener.ReadLine(t): true, listener.ReadLine(t): true}
+	if !received[fmt.Sprintf("[%s] %s: see you later", testGame.tag, talker.name)] ||
+		!received[fmt.Sprintf("%s whispers: come back", talker.name)] {
+		t.Fatalf("Incorrect chat after reconnecting: %v", received)
+	}
+
+	testGame.server.CleanUp(t)
+}
+
+func TestFinal_ConcurrentChat(t *testing.T) {
+	testGame := NewTestGame(t, 3)
+	testGame.GameSetup(t)
+	testGame.OpenGame(t, "min=3 max=3")
+
+	// everyone talks at once, the game must not wait on a player that
+	// waits on the game
+	const says = 200
+	chats := make(chan int, len(testGame.players))
+	for _, player := range testGame.players {
+		go func(player *TestPlayer) {
+			var lines strings.Builder
+			for i := 0; i < says; i++ {
+				fmt.Fprintf(&lines, "SAY %s message %d\n", testGame.tag, i)
+			}
+			player.conn.Write([]byte(lines.String()))
+		}(player)
+		go func(player *TestPlayer) {
+			reader := bufio.NewReader(player.conn)
+			count := 0
+			player.conn.SetReadDeadline(time.Now().Add(20 * time.Second))
+			for count < 2*says {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					break
+				}
+				if strings.HasPrefix(line, "["+testGame.tag+"] ") {
+					count++
+				}
+			}
+			chats <- count
+		}(player)
+	}
+	for range testGame.players {
+		if count := <-chats; count != 2*says {
+			t.Fatalf("Incorrect number of CHAT lines: %d of %d", count, 2*says)
+		}
+	}
+
+	testGame.server.CleanUp(t)
+}
+
+func TestFinal_Admin(t *testing.T) {
+	dir := t.TempDir()
+	gameServer, err := NewServer(RunningProtocol, "localhost:0", dir+"/"+StorageDirectoryName)
+	if err != nil {
+		t.Fatalf("Error in server creation: %v", err.Error())
+	}
+	if _, err := gameServer.ListenAdmin("tcp:0.0.0.0:0"); err == nil {
+		t.Fatalf("Admin socket accepted an address open to other hosts")
+	}
+	// a socket left behind by a server that did not exit cleanly
+	stale, err := net.Listen(UnixProtocol, dir+"/admin.sock")
+	if err != nil {
+		t.Fatalf("Error in stale socket creation: %v", err.Error())
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	adminAddr, err := gameServer.ListenAdmin("unix:" + dir + "/admin.sock")
+	if err != nil {
+		t.Fatalf("Error in admin socket creation: %v", err.Error())
+	}
+	go gameServer.Run()
+	ts := &TestServer{RunningProtocol, gameServer.Addrs()[0].String(), gameServer, dir + "/" + StorageDirectoryName}
+	conn, err := net.Dial(adminAddr.Network(), adminAddr.String())
+	if err != nil {
+		t.Fatalf("Error in connection to the admin socket: %v", err.Error())
+	}
+	lateConn, err := net.Dial(adminAddr.Network(), adminAddr.String())
+	if err != nil {
+		t.Fatalf("Error in connection to the admin socket: %v", err.Error())
+	}
+	admin := &TestPlayer{name: "admin", conn: conn}
+	command := func(cmd string) []string {
+		admin.conn.Write([]byte(cmd + "\n"))
+		lines := make([]string, 0)
+		for {
+			line := admin.ReadLine(t)
+			if line == "OK" || strings.HasPrefix(line, "ERROR") {
+				return append(lines, line)
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	leader := NewPlayer(t, ts, 0)
+	player := NewPlayer(t, ts, 1)
+	for _, p := range []*TestPlayer{leader, player} {
+		p.SendHello(t)
+		p.ReadResponse(t)
+	}
+	tag := randSeq(6)
+	leader.SendNewGame(t, tag+" min=2")
+	leader.ReadResponse(t)
+	player.SendJoinGame(t, tag)
+	player.ReadResponse(t)
+	leader.ReadResponse(t)
+
+	resp := command("GAMES")
+	expected := fmt.Sprintf("%s state=READY leader=Player0 picker= round=0 players=2 disconnected=0 spectators=0", tag)
+	if len(resp) != 2 || resp[0] != expected {
+		t.Fatalf("Incorrect response to GAMES: %v", resp)
+	}
+	resp = command("PLAYERS")
+	if len(resp) != 3 || resp[0] != "Player0 games="+tag+" watching=" || resp[1] != "Player1 games="+tag+" watching=" {
+		t.Fatalf("Incorrect response to PLAYERS: %v", resp)
+	}
+
+	// a kicked player is disconnected but keeps its seat
+	resp = command("KICK Player1")
+	if resp[0] != "OK" {
+		t.Fatalf("Incorrect response to KICK: %v", resp)
+	}
+	ts.WaitDisconnected(t, tag, "Player1")
+	resp = command("GAMES")
+	expected = fmt.Sprintf("%s state=WAITING leader=Player0 picker= round=0 players=1 disconnected=1 spectators=0", tag)
+	if resp[0] != expected {
+		t.Fatalf("Incorrect response to GAMES after KICK: %v", resp)
+	}
+	resp = command("KICK Player1")
+	if resp[0] != "ERROR player Player1 is not connected" {
+		t.Fatalf("Incorrect response to KICK of a disconnected player: %v", resp)
+	}
+
+	resp = command("CLOSE_GAME " + tag)
+	if resp[0] != "OK" {
+		t.Fatalf("Incorrect response to CLOSE_GAME: %v", resp)
+	}
+	if resp := leader.ReadLine(t); resp != "Bye!" {
+		t.Fatalf("Incorrect notification of a closed game: %s", resp)
+	}
+	resp = command("GAMES")
+	if len(resp) != 1 {
+		t.Fatalf("Closed game is still listed: %v", resp)
+	}
+
+	resp = command("SHUTDOWN")
+	if resp[0] != "OK" {
+		t.Fatalf("Incorrect response to SHUTDOWN: %v", resp)
+	}
+	if _, err := net.Dial(RunningProtocol, ts.addr); err == nil {
+		t.Fatalf("Server still accepts connections after SHUTDOWN")
+	}
+	admin = &TestPlayer{name: "admin", conn: lateConn}
+	resp = command("GAMES")
+	if resp[0] != "ERROR shutting down" {
+		t.Fatalf("Incorrect response to GAMES after SHUTDOWN: %v", resp)
+	}
+}
+
+func TestFinal_UploadFraming(t *testing.T) {
+	testGame := NewTestGame(t, 2)
+	testGame.GameSetup(t)
+	leader := testGame.players[0]
+	player := testGame.players[1]
+	testGame.OpenGame(t, "min=2")
+	leader.SendStartGame(t, testGame.tag)
+	leader.ReadLine(t)
+	player.ReadLine(t)
+
+	// CRLF line breaks and a line longer than bufio.Scanner's limit
+	contents := "alpha beta\r\n" + strings.Repeat("gamma ", 12000) + "\r\nbeta\r\n"
+	sum := sha256.Sum256([]byte(contents))
+	checksum := hex.EncodeToString(sum[:])
+
+	leader.conn.Write([]byte(fmt.Sprintf("FILE_UPLOAD %s bad.txt sha256=%s %d %s\n",
+		testGame.tag, strings.Repeat("0", 64), len(contents), contents)))
+	resp := leader.ReadLine(t)
+	if resp != "The file does not match its checksum. Please upload it again." {
+		t.Fatalf("Incorrect response to FILE_UPLOAD with a bad checksum: %s", resp)
+	}
+	leader.conn.Write([]byte(fmt.Sprintf("FILE_UPLOAD %s long.txt 3 abcdef\n", testGame.tag)))
+	resp = leader.ReadLine(t)
+	if resp != "The file is longer than the declared 3 bytes." {
+		t.Fatalf("Incorrect response to FILE_UPLOAD with an oversized payload: %s", resp)
+	}
+	leader.conn.Write([]byte(fmt.Sprintf("FILE_UPLOAD %s nosize.txt many words\n", testGame.tag)))
+	resp = leader.ReadLine(t)
+	if resp != "Invalid file size many." {
+		t.Fatalf("Incorrect response to FILE_UPLOAD without a size: %s", resp)
+	}
+	leader.conn.Write([]byte(fmt.Sprintf("FILE_UPLOAD %s ../escaped.txt 11 hello world\n", testGame.tag)))
+	resp = leader.ReadLine(t)
+	if resp != "Invalid file name, it may not start with a dot or contain slashes." {
+		t.Fatalf("Incorrect response to FILE_UPLOAD outside the game's directory: %s", resp)
+	}
+	if _, err := os.Stat(testGame.server.directory + "escaped.txt"); err == nil {
+		t.Fatalf("FILE_UPLOAD wrote outside the game's directory")
+	}
+
+	// the data may also start on the line after the header, the game keeps
+	// serving the others while the leader uploads. The leader does not
+	// need to see the chat.
+	leader.conn.Write([]byte(fmt.Sprintf("MUTE %s\n", player.name)))
+	leader.ReadLine(t)
+	talking := make(chan bool)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-talking:
+				talking <- true
+				return
+			default:
+				player.conn.Write([]byte(fmt.Sprintf("SAY %s message %d\n", testGame.tag, i)))
+			}
+		}
+	}()
+	leader.conn.Write([]byte(fmt.Sprintf("FILE_UPLOAD %s words.txt sha256=%s %d\n%s\n",
+		testGame.tag, checksum, len(contents), contents)))
+	resp = leader.ReadLine(t)
+	talking <- true
+	<-talking
+	if resp != "Upload completed! Waiting for word selection." {
+		t.Fatalf("Incorrect response to a framed FILE_UPLOAD: %s", resp)
+	}
+	stored, err := ioutil.ReadFile(testGame.server.directory + testGame.tag + "/words.txt")
+	if err != nil {
+		t.Fatalf("Error in reading the uploaded file: %v", err.Error())
+	}
+	if string(stored) != contents {
+		t.Fatalf("Uploaded file differs: %d bytes instead of %d", len(stored), len(contents))
+	}
+	player.ReadLine(t)
+	// the answer to SCORES comes once the player is done talking
+	player.conn.Write([]byte(fmt.Sprintf("SCORES %s\n", testGame.tag)))
+	if resp = player.ReadLine(t); resp != fmt.Sprintf("No rounds have been played in game %s yet.", testGame.tag) {
+		t.Fatalf("Incorrect response to SCORES after the chat: %s", resp)
+	}
+
+	// the connection reads commands again after the upload
+	leader.SendRandomWord(t, testGame.tag, "beta")
+	resp = leader.ReadLine(t)
+	if !strings.HasPrefix(resp, "Only the picker can pick the word.") {
+		t.Fatalf("Incorrect response to RANDOM_WORD after the upload: %s", resp)
+	}
+	// only the data of an upload may be longer than a command line
+	leader.conn.Write([]byte(fmt.Sprintf("SAY %s %s\n", testGame.tag, strings.Repeat("x", MAX_LINE_LENGTH))))
+	resp = leader.ReadLine(t)
+	if resp != fmt.Sprintf("The command is too long, the limit is %d bytes.", MAX_LINE_LENGTH) {
+		t.Fatalf("Incorrect response to a command over the line limit: %s", resp)
+	}
+	leader.conn.Write([]byte(strings.Repeat("y", MAX_LINE_LENGTH+1) + "\n"))
+	resp = leader.ReadLine(t)
+	if resp != fmt.Sprintf("The command is too long, the limit is %d bytes.", MAX_LINE_LENGTH) {
+		t.Fatalf("Incorrect response to a word over the line limit: %s", resp)
+	}
+	leader.SendRandomWord(t, testGame.tag, "beta")
+	resp = leader.ReadLine(t)
+	if !strings.HasPrefix(resp, "Only the picker can pick the word.") {
+		t.Fatalf("Incorrect response to RANDOM_WORD after a long line: %s", resp)
+	}
+	// refused before its data arrives
+	leader.conn.Write([]byte(fmt.Sprintf("FILE_UPLOAD %s huge.txt %d\n", testGame.tag, MAX_UPLOAD_SIZE+1)))
+	resp = leader.ReadLine(t)
+	if resp != fmt.Sprintf("The file is too large, the limit is %d bytes.", MAX_UPLOAD_SIZE) {
+		t.Fatalf("Incorrect response to FILE_UPLOAD over the limit: %s", resp)
+	}
+
+	testGame.server.CleanUp(t)
+}
+
+func TestFinal_ChunkedUpload(t *testing.T) {
+	directory := t.TempDir() + "/"
+	testGame := &TestGame{
+		players:     make([]*TestPlayer, 0),
+		server:      NewTestServerAt(t, directory),
+		playerCount: 2,
+	}
+	testGame.GameSetup(t)
+	leader := testGame.players[0]
+	player := testGame.players[1]
+	testGame.OpenGame(t, "min=2")
+	leader.SendStartGame(t, testGame.tag)
+	leader.ReadLine(t)
+	player.ReadLine(t)
+
+	contents := strings.Repeat("the quick brown fox\r\n", 100)
+	half := len(contents) / 2
+	sum := sha256.Sum256([]byte(contents))
+	send := func(tp *TestPlayer, cmd string) string {
+		tp.conn.Write([]byte(cmd + "\n"))
+		return tp.ReadLine(t)
+	}
+
+	resp := send(player, fmt.Sprintf("UPLOAD_BEGIN %s corpus.txt %d", testGame.tag, len(contents)))
+	if resp != fmt.Sprintf("Only the leader can upload the file. Please contact %s.", leader.name) {
+		t.Fatalf("Incorrect response to UPLOAD_BEGIN by a non-leader: %s", resp)
+	}
+	resp = send(leader, fmt.Sprintf("UPLOAD_BEGIN %s corpus.txt %d sha256=%s", testGame.tag, len(contents), hex.EncodeToString(sum[:])))
+	if resp != fmt.Sprintf("Upload of corpus.txt started. Send %d bytes from offset 0.", len(contents)) {
+		t.Fatalf("Incorrect response to UPLOAD_BEGIN: %s", resp)
+	}
+	resp = send(leader, fmt.Sprintf("UPLOAD_CHUNK %s 0 %d %s", testGame.tag, half, contents[:half]))
+	if resp != fmt.Sprintf("Received %d of %d bytes of corpus.txt.", half, len(contents)) {
+		t.Fatalf("Incorrect response to UPLOAD_CHUNK: %s", resp)
+	}
+	resp = send(leader, fmt.Sprintf("UPLOAD_CHUNK %s 0 %d %s", testGame.tag, half, contents[:half]))
+	if resp != fmt.Sprintf("Wrong offset! Send the data from offset %d.", half) {
+		t.Fatalf("Incorrect response to UPLOAD_CHUNK at a wrong offset: %s", resp)
+	}
+	resp = send(leader, "UPLOAD_COMMIT "+testGame.tag)
+	if resp != fmt.Sprintf("Upload incomplete! Received %d of %d bytes.", half, len(contents)) {
+		t.Fatalf("Incorrect response to an early UPLOAD_COMMIT: %s", resp)
+	}
+
+	// the session survives a restart of the server
+	testGame.server.gameServer.Close()
+	for _, p := range testGame.players {
+		p.Close()
+		p.pending = nil
+	}
+	testGame.server = NewTestServerAt(t, directory)
+	for _, p := range testGame.players {
+		p.conn = testGame.server.Connect(t)
+		p.SendHello(t)
+		p.ReadLine(t)
+	}
+	resp = leader.ReadLine(t)
+	if resp != fmt.Sprintf("Upload of corpus.txt stopped at %d of %d bytes. Continue from offset %d.", half, len(contents), half) {
+		t.Fatalf("Incorrect reminder of the upload after reconnecting: %s", resp)
+	}
+	resp = send(leader, fmt.Sprintf("UPLOAD_CHUNK %s %d %d %s", testGame.tag, half, len(contents)-half, contents[half:]))
+	if resp != fmt.Sprintf("Received %d of %d bytes of corpus.txt.", len(contents), len(contents)) {
+		t.Fatalf("Incorrect response to the last UPLOAD_CHUNK: %s", resp)
+	}
+	leader.conn.Write([]byte("UPLOAD_COMMIT " + testGame.tag + "\n"))
+	pickerResponse := "Upload completed! Please select a word from corpus.txt."
+	for _, p := range testGame.players {
+		resp = p.ReadLine(t)
+		if resp == pickerResponse {
+			testGame.picker = p
+		} else if resp != "Upload completed! Waiting for word selection." {
+			t.Fatalf("Incorrect notification after UPLOAD_COMMIT: %s", resp)
+		}
+	}
+	stored, err := ioutil.ReadFile(directory + testGame.tag + "/corpus.txt")
+	if err != nil || string(stored) != contents {
+		t.Fatalf("Committed file differs from the upload: %v", err)
+	}
+	// the round has its file, another one would pull it out from under the picker
+	resp = send(leader, fmt.Sprintf("UPLOAD_BEGIN %s other.txt %d", testGame.tag, len(contents)))
+	if resp != fmt.Sprintf("Game %s takes the file once it is running and until the word is picked.", testGame.tag) {
+		t.Fatalf("Incorrect response to UPLOAD_BEGIN after the file is in place: %s", resp)
+	}
+	testGame.picker.SendRandomWord(t, testGame.tag, "fox")
+	for _, p := range testGame.players {
+		p.ReadLine(t)
+	}
+	leader.conn.Write([]byte(fmt.Sprintf("FILE_UPLOAD %s other.txt 5 hello\n", testGame.tag)))
+	resp = leader.ReadLine(t)
+	if resp != fmt.Sprintf("Game %s takes the file once it is running and until the word is picked.", testGame.tag) {
+		t.Fatalf("Incorrect response to FILE_UPLOAD after the word is picked: %s", resp)
+	}
+	if _, err := os.Stat(directory + testGame.tag + "/other.txt"); err == nil {
+		t.Fatalf("FILE_UPLOAD after the word is picked stored the file")
+	}
+	testGame.server.gameServer.Close()
+}
+
+func TestFinal_Tokenizer(t *testing.T) {
+	if got := strings.Join(foldedWords("Don't  count\tTHY, thy."), " "); got != "don't count thy thy" {
+		t.Fatalf("Incorrect words from the fold tokenizer: %s", got)
+	}
+	if got := strings.Join(stemmedWords("Counting counted counts"), " "); got != "count count count" {
+		t.Fatalf("Incorrect words from the stem tokenizer: %s", got)
+	}
+
+	testGame := NewTestGame(t, 2)
+	testGame.GameSetup(t)
+	leader := testGame.players[0]
+	picker := testGame.players[1]
+	testGame.tag = randSeq(6)
+
+	leader.SendNewGame(t, testGame.tag+" tokenizer=nope")
+	resp := leader.ReadResponse(t)
+	if resp != "Invalid game rules: invalid value nope for rule tokenizer." {
+		t.Fatalf("Incorrect response to NEW_GAME with an unknown tokenizer: %s", resp)
+	}
+	testGame.OpenGame(t, "min=2 tokenizer=fold")
+	testGame.StartGame(t)
+	testGame.GetFileSize(t)
+	leader.SendFileUpload(t, testGame.tag, testGame.fileName, testGame.fileSize)
+	leader.ReadLine(t)
+	picker.ReadLine(t)
+
+	// the picked word is counted the way the file is
+	picker.SendRandomWord(t, testGame.tag, "THY,")
+	for _, p := range testGame.players {
+		resp = p.ReadLine(t)
+		if resp != "Word selected is thy! Guess the word count." {
+			t.Fatalf("Incorrect notification of a word picked with the fold tokenizer: %s", resp)
+		}
+	}
+	contents, err := ioutil.ReadFile(testGame.fileName)
+	if err != nil {
+		t.Fatalf("Error in reading %s: %v", testGame.fileName, err)
+	}
+	actual := 0
+	for _, word := range foldedWords(string(contents)) {
+		if word == "thy" {
+			actual++
+		}
+	}
+	if actual == testGame.CountWord(t, "thy") {
+		t.Fatalf("The test file does not tell the fold tokenizer from the whitespace one")
+	}
+	leader.SendGuessCount(t, testGame.tag, int64(actual))
+	picker.SendGuessCount(t, testGame.tag, int64(2*actual))
+	resp = leader.ReadLine(t)
+	if resp != "Congratulations you are the winner!" {
+		t.Fatalf("Incorrect response to the exact count of the fold tokenizer: %s", resp)
+	}
+
+	testGame.server.CleanUp(t)
+}
+
+func TestFinal_ArchiveUpload(t *testing.T) {
+	testGame := NewTestGame(t, 2)
+	testGame.GameSetup(t)
+	leader := testGame.players[0]
+	player := testGame.players[1]
+	testGame.OpenGame(t, "min=2")
+	leader.SendStartGame(t, testGame.tag)
+	leader.ReadLine(t)
+	player.ReadLine(t)
+	upload := func(fileName string, data []byte) {
+		leader.conn.Write([]byte(fmt.Sprintf("FILE_UPLOAD %s %s %d ", testGame.tag, fileName, len(data))))
+		leader.conn.Write(append(data, '\n'))
+	}
+
+	var zipped bytes.Buffer
+	zw := zip.NewWriter(&zipped)
+	w, _ := zw.Create("../evil.txt")
+	w.Write([]byte("zebra"))
+	zw.Close()
+	upload("evil.zip", zipped.Bytes())
+	resp := leader.ReadLine(t)
+	if resp != "The archive has a file outside its own directory." {
+		t.Fatalf("Incorrect response to a zip with a path traversal: %s", resp)
+	}
+
+	// a gzip bomb, text that compresses far better than any corpus
+	var bomb bytes.Buffer
+	gw := gzip.NewWriter(&bomb)
+	gw.Write(bytes.Repeat([]byte("a"), MAX_UPLOAD_SIZE+1))
+	gw.Close()
+	upload("bomb.txt.gz", bomb.Bytes())
+	resp = leader.ReadLine(t)
+	if resp != "The archive is too large when extracted." {
+		t.Fatalf("Incorrect response to a gzip bomb: %s", resp)
+	}
+
+	var tarred bytes.Buffer
+	gw = gzip.NewWriter(&tarred)
+	tw := tar.NewWriter(gw)
+	members := []struct{ name, data string }{
+		{"a.txt", "zebra lion zebra"},
+		{"b/c.txt", "zebra zebra zebra horse"},
+		{"image.png", "\x89PNG\r\n\x1a\n\x00\x00zebra"},
+	}
+	for _, member := range members {
+		tw.WriteHeader(&tar.Header{Name: member.name, Mode: 0644, Size: int64(len(member.data)), Typeflag: tar.TypeReg})
+		tw.Write([]byte(member.data))
+	}
+	tw.Close()
+	gw.Close()
+	upload("corpus.tar.gz", tarred.Bytes())
+	resp = player.ReadLine(t)
+	if resp != "Upload completed! Please select a word from corpus.tar.gz (corpus/a.txt, corpus/b/c.txt)." {
+		t.Fatalf("Incorrect PICK notification for a tar.gz upload: %s", resp)
+	}
+	leader.ReadLine(t)
+
+	// one wordDict of all text files
+	player.SendRandomWord(t, testGame.tag, "zebra")
+	leader.ReadLine(t)
+	player.ReadLine(t)
+	leader.SendGuessCount(t, testGame.tag, 5)
+	player.SendGuessCount(t, testGame.tag, 6)
+	resp = leader.ReadLine(t)
+	if resp != "Congratulations you are the winner!" {
+		t.Fatalf("Incorrect count of a word in a tar.gz upload: %s", resp)
+	}
+
+	testGame.server.CleanUp(t)
+}
+
+func TestFinal_PickRules(t *testing.T) {
+	testGame := NewTestGame(t, 2)
+	testGame.GameSetup(t)
+	leader := testGame.players[0]
+	picker := testGame.players[1]
+	testGame.OpenGame(t, "min=2 tokenizer=fold minLength=3 minCount=2 maxCount=3 stopWords=english")
+	leader.SendStartGame(t, testGame.tag)
+	leader.ReadLine(t)
+	picker.ReadLine(t)
+	data := []byte("The the THE zebra zebra ox ox eel yak yak yak yak lion lion lion")
+	leader.conn.Write([]byte(fmt.Sprintf("FILE_UPLOAD %s animals.txt %d ", testGame.tag, len(data))))
+	leader.conn.Write(append(data, '\n'))
+	leader.ReadLine(t)
+	picker.ReadLine(t)
+
+	leader.conn.Write([]byte("HINTS " + testGame.tag + "\n"))
+	resp := leader.ReadLine(t)
+	if resp != fmt.Sprintf("Only the picker gets hints. Please contact %s.", picker.name) {
+		t.Fatalf("Incorrect response to HINTS from a player who does not pick: %s", resp)
+	}
+	picker.conn.Write([]byte("HINTS " + testGame.tag + "\n"))
+	resp = picker.ReadLine(t)
+	if resp != "Words you may pick, medium: zebra; frequent: lion." {
+		t.Fatalf("Incorrect response to HINTS: %s", resp)
+	}
+
+	refused := map[string]string{
+		"ox":  "Word ox is too short for the rules of the game, choose a longer word.",
+		"The": "Word the may not be picked in this game, choose another word.",
+		"eel": "Word eel is too rare for the rules of the game, choose a more common word.",
+		"yak": "Word yak is too common for the rules of the game, choose a rarer word.",
+	}
+	for word, expected := range refused {
+		picker.SendRandomWord(t, testGame.tag, word)
+		if resp = picker.ReadLine(t); resp != expected {
+			t.Fatalf("Incorrect response to RANDOM_WORD %s: %s", word, resp)
+		}
+	}
+	picker.SendRandomWord(t, testGame.tag, "lion")
+	if resp = picker.ReadLine(t); resp != "Word selected is lion! Guess the word count." {
+		t.Fatalf("Incorrect response to RANDOM_WORD within the pick rules: %s", resp)
+	}
+	leader.ReadLine(t)
+	picker.conn.Write([]byte("HINTS " + testGame.tag + "\n"))
+	if resp = picker.ReadLine(t); resp != "The word has already been selected." {
+		t.Fatalf("Incorrect response to HINTS after the pick: %s", resp)
+	}
+
+	testGame.server.CleanUp(t)
+}
+
+func TestFinal_ServerPick(t *testing.T) {
+	testGame := NewTestGame(t, 2)
+	testGame.GameSetup(t)
+	leader := testGame.players[0]
+	player := testGame.players[1]
+	data := []byte("alpha alpha beta beta gamma delta delta delta")
+	play := func(rules string) {
+		testGame.OpenGame(t, "min=2 picker=server "+rules)
+		leader.SendStartGame(t, testGame.tag)
+		leader.ReadLine(t)
+		player.ReadLine(t)
+		leader.conn.Write([]byte(fmt.Sprintf("FILE_UPLOAD %s words.txt %d ", testGame.tag, len(data))))
+		leader.conn.Write(append(data, '\n'))
+		for _, p := range testGame.players {
+			if resp := p.ReadLine(t); resp != "Upload completed! Waiting for word selection." {
+				t.Fatalf("Incorrect response to FILE_UPLOAD when the server picks: %s", resp)
+			}
+		}
+	}
+
+	// the same seed picks the same word of the same file
+	rules, _ := parseRules([]string{"minCount=2", "seed=7"})
+	game := &Game{rules: rules, wordDict: map[string]int{"alpha": 2, "beta": 2, "gamma": 1, "delta": 3}, usedWords: make(map[string]bool)}
+	expected := strings.Join(game.serverPick(), " ")
+	if expected == "" || expected == "gamma" || strings.Join(game.serverPick(), " ") != expected {
+		t.Fatalf("Incorrect word picked by a seeded server: %s", expected)
+	}
+	play("minCount=2 seed=7")
+	for _, p := range testGame.players {
+		if resp := p.ReadLine(t); resp != fmt.Sprintf("Word selected is %s! Guess the word count.", expected) {
+			t.Fatalf("Incorrect word selected by the server: %s", resp)
+		}
+	}
+	player.SendRandomWord(t, testGame.tag, "alpha")
+	if resp := player.ReadLine(t); resp != "The server picks the word in this game." {
+		t.Fatalf("Incorrect response to RANDOM_WORD when the server picks: %s", resp)
+	}
+	leader.conn.Write([]byte("CLOSE " + testGame.tag + "\n"))
+	leader.ReadLine(t)
+	player.ReadLine(t)
+
+	// the game waits for the leader when no word is left to pick
+	play("minCount=5")
+	for _, p := range testGame.players {
+		expected := fmt.Sprintf("No word of the file can be picked under the rules of game %s. Waiting for %s to restart the game.", testGame.tag, leader.name)
+		if resp := p.ReadLine(t); resp != expected {
+			t.Fatalf("Incorrect notification when the server has no word to pick: %s", resp)
+		}
+	}
+
+	testGame.server.CleanUp(t)
+}
+
+func TestFinal_MultipleWords(t *testing.T) {
+	testGame := NewTestGame(t, 2)
+	testGame.GameSetup(t)
+	leader := testGame.players[0]
+	picker := testGame.players[1]
+	testGame.OpenGame(t, "min=2 words=2")
+	leader.SendStartGame(t, testGame.tag)
+	leader.ReadLine(t)
+	picker.ReadLine(t)
+	data := []byte("apple apple banana banana banana cherry")
+	leader.conn.Write([]byte(fmt.Sprintf("FILE_UPLOAD %s fruit.txt %d ", testGame.tag, len(data))))
+	leader.conn.Write(append(data, '\n'))
+	leader.ReadLine(t)
+	picker.ReadLine(t)
+
+	refused := map[string]string{
+		"apple":        "Pick 2 different words in this game, separated by spaces.",
+		"apple apple":  "Word apple is not a valid choice, choose another word.",
+		"apple durian": "Word durian is not a valid choice, choose another word.",
+	}
+	for words, expected := range refused {
+		picker.conn.Write([]byte("RANDOM_WORD " + testGame.tag + " " + words + "\n"))
+		if resp := picker.ReadLine(t); resp != expected {
+			t.Fatalf("Incorrect response to RANDOM_WORD %s: %s", words, resp)
+		}
+	}
+	picker.conn.Write([]byte("RANDOM_WORD " + testGame.tag + " apple banana\n"))
+	for _, p := range testGame.players {
+		if resp := p.ReadLine(t); resp != "Words selected are apple, banana! Guess the count of each word." {
+			t.Fatalf("Incorrect notification of the words of a round: %s", resp)
+		}
+	}
+
+	leader.SendGuessCount(t, testGame.tag, 2)
+	resp := leader.ReadLine(t)
+	if resp != fmt.Sprintf("Guess the count of each of the 2 words of game %s, in the order they were picked.", testGame.tag) {
+		t.Fatalf("Incorrect response to WORD_COUNT with one guess for two words: %s", resp)
+	}
+	// every word is scored on its own, the closest guesses overall win
+	leader.conn.Write([]byte("WORD_COUNT " + testGame.tag + " 2 3\n"))
+	picker.conn.Write([]byte("WORD_COUNT " + testGame.tag + " 1 3\n"))
+	if resp = leader.ReadLine(t); resp != "Congratulations you are the winner!" {
+		t.Fatalf("Incorrect result of a round with two words: %s", resp)
+	}
+	picker.ReadLine(t)
+	leader.ReadLine(t)
+	picker.conn.Write([]byte("SCORES " + testGame.tag + "\n"))
+	resp = picker.ReadLine(t)
+	if resp != fmt.Sprintf("Scores for game %s after round 1: %s 30, %s 20.", testGame.tag, leader.name, picker.name) {
+		t.Fatalf("Incorrect scores of a round with two words: %s", resp)
+	}
+
+	testGame.server.CleanUp(t)
+}
+
+func TestFinal_Authentication(t *testing.T) {
+	directory := t.TempDir() + "/"
+	server := NewTestServerAt(t, directory)
+	name, tag := "Auth"+randSeq(6), randSeq(6)
+	connect := func() *TestPlayer {
+		return &TestPlayer{name: name, conn: server.Connect(t)}
+	}
+	hello := func(tp *TestPlayer, credentials string) string {
+		tp.conn.Write([]byte("HELLO " + name + " " + credentials + "\n"))
+		return tp.ReadLine(t)
+	}
+
+	// the first password registers the name and comes with a token
+	alice := connect()
+	resp := hello(alice, "password=secret")
+	token, _, ok := strings.Cut(strings.TrimPrefix(resp, "Your resume token is "), ".")
+	if !ok || token == resp {
+		t.Fatalf("Incorrect response to HELLO registering a name: %s", resp)
+	}
+	alice.ReadLine(t)
+	alice.SendNewGame(t, tag)
+	alice.ReadLine(t)
+	alice.Close()
+
+	mallory := connect()
+	mallory.SendHello(t)
+	if resp = mallory.ReadLine(t); resp != fmt.Sprintf("%s is a registered name. Send HELLO %s password=<password> or token=<token>.", name, name) {
+		t.Fatalf("Incorrect response to HELLO without credentials for a registered name: %s", resp)
+	}
+	if resp = hello(mallory, "password=guess"); resp != "Wrong password. Try again." {
+		t.Fatalf("Incorrect response to HELLO with a wrong password: %s", resp)
+	}
+	// the third failure ends the connection
+	hello(mallory, "token=guess")
+	mallory.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := mallory.conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("Connection still open after three failed logins")
+	}
+
+	// the token resumes the game, also after a restart of the server
+	server.gameServer.Close()
+	server = NewTestServerAt(t, directory)
+	alice = connect()
+	if resp = hello(alice, "token="+token); resp != fmt.Sprintf("Welcome to Word Count %s! Resumed Game %s. Current state is WAITING.", name, tag) {
+		t.Fatalf("Incorrect response to HELLO with a resume token: %s", resp)
+	}
+	alice.Close()
+
+	server.CleanUp(t)
+}
+
+func TestFinal_Sessions(t *testing.T) {
+	directory := t.TempDir() + "/"
+	gameServer, err := NewServer(RunningProtocol, "localhost:0", directory)
+	if err != nil {
+		t.Fatalf("Error in server creation: %v", err)
+	}
+	gameServer.SetSessionTimeout(time.Second)
+	go gameServer.Run()
+	server := &TestServer{RunningProtocol, gameServer.Addrs()[0].String(), gameServer, directory}
+	leader := &TestPlayer{name: "Lead" + randSeq(6), conn: server.Connect(t)}
+	player := &TestPlayer{name: "Away" + randSeq(6), conn: server.Connect(t)}
+	tag := randSeq(6)
+	leader.SendHello(t)
+	leader.ReadLine(t)
+	leader.SendNewGame(t, tag+" min=2")
+	leader.ReadLine(t)
+
+	// JSON clients find the session token in the welcome
+	player.conn.Write([]byte(fmt.Sprintf(`{"cmd": "HELLO", "name": "%s"}`+"\n", player.name)))
+	session, _ := player.ReadJSON(t)["session"].(string)
+	if session == "" {
+		t.Fatalf("No session token in the welcome")
+	}
+	player.conn.Write([]byte(fmt.Sprintf(`{"cmd": "JOIN_GAME", "gameID": "%s"}`+"\n", tag)))
+	player.ReadLine(t)
+	leader.ReadLine(t)
+	player.Close()
+	server.WaitDisconnected(t, tag, player.name)
+
+	// the token stands for the name, a new session replaces it
+	player.conn = server.Connect(t)
+	player.conn.Write([]byte("RESUME " + session + "\n"))
+	resp := player.ReadLine(t)
+	if !strings.HasPrefix(resp, fmt.Sprintf("Welcome to Word Count %s! Resumed Game %s.", player.name, tag)) {
+		t.Fatalf("Incorrect response to RESUME: %s", resp)
+	}
+	player.conn.Write([]byte("SESSION\n"))
+	resp = player.ReadLine(t)
+	newSession, _, _ := strings.Cut(strings.TrimPrefix(resp, "Your session token is "), ".")
+	if newSession == session || newSession == resp {
+		t.Fatalf("Incorrect response to SESSION: %s", resp)
+	}
+	player.Close()
+	player.conn = server.Connect(t)
+	player.conn.Write([]byte("RESUME " + session + "\n"))
+	if resp = player.ReadLine(t); resp != "Invalid or expired session. Send HELLO to start over." {
+		t.Fatalf("Incorrect response to RESUME with a replaced session: %s", resp)
+	}
+	player.Close()
+
+	// past the timeout the seat is released and the token is worthless
+	if resp = leader.ReadLine(t); resp != fmt.Sprintf("%s was away too long and left game %s.", player.name, tag) {
+		t.Fatalf("Incorrect notification of an expired session: %s", resp)
+	}
+	player.conn = server.Connect(t)
+	player.conn.Write([]byte("RESUME " + newSession + "\n"))
+	if resp = player.ReadLine(t); resp != "Invalid or expired session. Send HELLO to start over." {
+		t.Fatalf("Incorrect response to RESUME with an expired session: %s", resp)
+	}
+	player.SendHello(t)
+	if resp = player.ReadLine(t); resp != fmt.Sprintf("Welcome to Word Count %s! Do you want to create a new game or join an existing game?", player.name) {
+		t.Fatalf("Incorrect welcome after the seat expired: %s", resp)
+	}
+	player.Close()
+
+	server.CleanUp(t)
+}
+
+func TestFinal_TakeOver(t *testing.T) {
+	server := NewTestServer(t)
+	old := &TestPlayer{name: "Twice" + randSeq(6), conn: server.Connect(t)}
+	tag := randSeq(6)
+	old.SendHello(t)
+	old.ReadLine(t)
+	old.SendNewGame(t, tag)
+	old.ReadLine(t)
+
+	// a second HELLO detaches the first connection and resumes its game
+	player := &TestPlayer{name: old.name, conn: server.Connect(t)}
+	player.SendHello(t)
+	resp := player.ReadLine(t)
+	if resp != fmt.Sprintf("Welcome to Word Count %s! Resumed Game %s. Current state is WAITING.", old.name, tag) {
+		t.Fatalf("Incorrect response to HELLO for a player online on another connection: %s", resp)
+	}
+	if resp = old.ReadLine(t); resp != fmt.Sprintf("%s logged in on another connection. Bye!", old.name) {
+		t.Fatalf("Incorrect notification of the connection taken over: %s", resp)
+	}
+	old.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := old.conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("Connection taken over is still open")
+	}
+
+	// responses go to the new connection only
+	player.conn.Write([]byte("SCORES " + tag + "\n"))
+	if resp = player.ReadLine(t); resp != fmt.Sprintf("No rounds have been played in game %s yet.", tag) {
+		t.Fatalf("Incorrect response to SCORES after taking over: %s", resp)
+	}
+
+	// a connection that drops is replaced at once, again and again, while
+	// the game keeps telling the player something
+	talker := &TestPlayer{name: "Talker" + randSeq(6), conn: server.Connect(t)}
+	talker.SendHello(t)
+	talker.ReadLine(t)
+	talker.SendJoinGame(t, tag)
+	talker.ReadLine(t)
+	go io.Copy(io.Discard, talker.conn)
+	go func() {
+		for {
+			if _, err := talker.conn.Write([]byte(fmt.Sprintf("SAY %s still here\n", tag))); err != nil {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		player.Close()
+		player.conn = server.Connect(t)
+		player.pending = nil
+		player.SendHello(t)
+		resp = player.ReadLine(t)
+		if resp != fmt.Sprintf("Welcome to Word Count %s! Resumed Game %s. Current state is WAITING.", old.name, tag) {
+			t.Fatalf("Incorrect response to HELLO right after a disconnection: %s", resp)
+		}
+	}
+	talker.Close()
+	player.Close()
+
+	server.CleanUp(t)
+}
+
+func TestFinal_MultipleGames(t *testing.T) {
+	server := NewTestServer(t)
+	first := &TestPlayer{name: "First" + randSeq(6), conn: server.Connect(t)}
+	second := &TestPlayer{name: "Second" + randSeq(6), conn: server.Connect(t)}
+	tag1, tag2 := "a"+randSeq(6), "b"+randSeq(6)
+	first.SendHello(t)
+	first.ReadLine(t)
+	second.SendHello(t)
+	second.ReadLine(t)
+	first.SendNewGame(t, tag1+" min=2")
+	first.ReadLine(t)
+	second.SendJoinGame(t, tag1)
+	second.ReadLine(t)
+	first.ReadLine(t)
+
+	// in a second game every message tells which game it is about
+	second.SendNewGame(t, tag2+" min=2")
+	resp := second.ReadLine(t)
+	if resp != fmt.Sprintf("[%s] Game %s created! You are the leader of the game. Waiting for players to join.", tag2, tag2) {
+		t.Fatalf("Incorrect response to NEW_GAME for a player in two games: %s", resp)
+	}
+	first.SendJoinGame(t, tag2)
+	if resp = first.ReadLine(t); !strings.HasPrefix(resp, fmt.Sprintf("[%s] Joined Game %s.", tag2, tag2)) {
+		t.Fatalf("Incorrect response to JOIN_GAME for a player in two games: %s", resp)
+	}
+	second.ReadLine(t)
+
+	first.conn.Write([]byte("MY_GAMES\n"))
+	expected := []string{
+		"Your games:",
+		fmt.Sprintf("Game %s: READY, round 0, you are the leader.", tag1),
+		fmt.Sprintf("Game %s: READY, round 0, you are the player.", tag2),
+	}
+	for _, line := range expected {
+		if resp = first.ReadLine(t); resp != line {
+			t.Fatalf("Incorrect response to MY_GAMES: %s, expected %s", resp, line)
+		}
+	}
+
+	// a reconnection resumes both games
+	second.Close()
+	server.WaitDisconnected(t, tag1, second.name)
+	server.WaitDisconnected(t, tag2, second.name)
+	second.conn = server.Connect(t)
+	second.SendHello(t)
+	for _, tag := range []string{tag1, tag2} {
+		if resp = second.ReadLine(t); resp != fmt.Sprintf("[%s] Welcome to Word Count %s! Resumed Game %s. Current state is READY.", tag, second.name, tag) {
+			t.Fatalf("Incorrect welcome to a player in two games: %s", resp)
+		}
+	}
+	first.Close()
+	second.Close()
+
+	server.CleanUp(t)
+}
+
+func TestFinal_Lobby(t *testing.T) {
+	server := NewTestServer(t)
+	watcher := &TestPlayer{name: "Watch" + randSeq(6), conn: server.Connect(t)}
+	leader := &TestPlayer{name: "Lead" + randSeq(6), conn: server.Connect(t)}
+	player := &TestPlayer{name: "Join" + randSeq(6), conn: server.Connect(t)}
+	tag := randSeq(6)
+	for _, tp := range []*TestPlayer{watcher, leader, player} {
+		tp.SendHello(t)
+		tp.ReadLine(t)
+	}
+	listGames := func(options string) []string {
+		watcher.conn.Write([]byte(strings.TrimSpace("LIST_GAMES "+options) + "\n"))
+		lines := []string{watcher.ReadLine(t)}
+		for len(watcher.pending) > 0 && watcher.pending[0] != "" {
+			lines = append(lines, watcher.ReadLine(t))
+		}
+		return lines
+	}
+
+	watcher.conn.Write([]byte("WATCH_LOBBY\n"))
+	if resp := watcher.ReadLine(t); resp != "Watching the lobby. You will be told when games open, fill up, start or close." {
+		t.Fatalf("Incorrect response to WATCH_LOBBY: %s", resp)
+	}
+	leader.SendNewGame(t, tag+" min=2 max=2")
+	leader.ReadLine(t)
+	expected := fmt.Sprintf("Game %s is open: WAITING, 1 of 2 players, leader %s. Send JOIN_GAME %s to join.", tag, leader.name, tag)
+	if resp := watcher.ReadLine(t); resp != expected {
+		t.Fatalf("Incorrect notification of a new game in the lobby: %s", resp)
+	}
+
+	// the filters pick the games of the list
+	listed := fmt.Sprintf("Game %s: WAITING, 1 of 2 players, leader %s.", tag, leader.name)
+	if lines := listGames("leader=" + leader.name); len(lines) != 2 || lines[0] != "Games:" || lines[1] != listed {
+		t.Fatalf("Incorrect response to LIST_GAMES: %q", lines)
+	}
+	for _, options := range []string{"state=RUNNING", "free=2", "leader=nobody"} {
+		if lines := listGames(options); lines[0] != "No games found. Create one with NEW_GAME <gameTag>." {
+			t.Fatalf("Incorrect response to LIST_GAMES %s: %q", options, lines)
+		}
+	}
+	if lines := listGames("colour=red"); lines[0] != "Invalid arguments for command LIST_GAMES." {
+		t.Fatalf("Incorrect response to LIST_GAMES with an unknown filter: %q", lines)
+	}
+
+	// a game that fills up leaves the open games
+	player.SendJoinGame(t, tag)
+	player.ReadLine(t)
+	if resp := watcher.ReadLine(t); resp != fmt.Sprintf("Game %s is full.", tag) {
+		t.Fatalf("Incorrect notification of a full game in the lobby: %s", resp)
+	}
+	if lines := listGames("leader=" + leader.name); lines[0] != "No games found. Create one with NEW_GAME <gameTag>." {
+		t.Fatalf("Incorrect response to LIST_GAMES after the game filled up: %q", lines)
+	}
+	full := fmt.Sprintf("Game %s: FULL, 2 of 2 players, leader %s.", tag, leader.name)
+	if lines := listGames("state=full leader=" + leader.name); len(lines) != 2 || lines[1] != full {
+		t.Fatalf("Incorrect response to LIST_GAMES state=full: %q", lines)
+	}
+
+	// so does a game that starts or is closed
+	started, closed := randSeq(6), randSeq(6)
+	leader.SendNewGame(t, started+" min=2 max=3")
+	leader.ReadLine(t)
+	watcher.ReadLine(t)
+	player.SendJoinGame(t, started)
+	player.ReadLine(t)
+	leader.ReadLine(t)
+	leader.SendStartGame(t, started)
+	if resp := watcher.ReadLine(t); resp != fmt.Sprintf("Game %s has started.", started) {
+		t.Fatalf("Incorrect notification of a started game in the lobby: %s", resp)
+	}
+	leader.ReadLine(t)
+	leader.SendNewGame(t, closed)
+	leader.ReadLine(t)
+	watcher.ReadLine(t)
+	leader.SendClose(t, closed)
+	if resp := watcher.ReadLine(t); resp != fmt.Sprintf("Game %s was closed.", closed) {
+		t.Fatalf("Incorrect notification of a closed game in the lobby: %s", resp)
+	}
+	if lines := listGames("state=waiting,ready,full,running leader=" + leader.name); len(lines) != 3 {
+		t.Fatalf("Incorrect response to LIST_GAMES after a game was closed: %q", lines)
+	}
+	watcher.Close()
+	leader.Close()
+	player.Close()
+
+	server.CleanUp(t)
+}
+
+func TestFinal_DocumentFormats(t *testing.T) {
+	testGame := NewTestGame(t, 2)
+	testGame.GameSetup(t)
+	leader := testGame.players[0]
+	player := testGame.players[1]
+	testGame.OpenGame(t, "min=2 ties=shared")
+	leader.SendStartGame(t, testGame.tag)
+	leader.ReadLine(t)
+	player.ReadLine(t)
+	upload := func(fileName string, options string, data []byte) {
+		leader.conn.Write([]byte(fmt.Sprintf("FILE_UPLOAD %s %s %s %d ", testGame.tag, fileName, options, len(data))))
+		leader.conn.Write(append(data, '\n'))
+	}
+
+	csvData := "animal,id\nzebra,zebra\nzebra,1\n"
+	upload("data.csv", "format=pdf", []byte(csvData))
+	resp := leader.ReadLine(t)
+	if resp != "Unknown format, use text, html, markdown, csv or json." {
+		t.Fatalf("Incorrect response to FILE_UPLOAD with an unknown format: %s", resp)
+	}
+	upload("data.csv", "columns=nope", []byte(csvData))
+	resp = leader.ReadLine(t)
+	if resp != "The CSV file data.csv has no column nope." {
+		t.Fatalf("Incorrect response to FILE_UPLOAD with an unknown CSV column: %s", resp)
+	}
+
+	// every format counts only the zebras a reader sees
+	var zipped bytes.Buffer
+	zw := zip.NewWriter(&zipped)
+	members := []struct{ name, data string }{
+		{"page.html", `<html><head><style>.zebra{}</style><script>var zebra = 1</script></head>` +
+			`<body><p class="zebra">a zebra</p><!-- zebra --></body></html>`},
+		{"notes.md", "# zebra\n\n```\nzebra\n```\n[zebra](http://zebra.example) and *zebra*\n"},
+		{"data.csv", csvData},
+		{"log.jsonl", `{"zebra": "zebra"}` + "\n" + `{"msg": ["zebra", 3]}` + "\n"},
+	}
+	for _, member := range members {
+		w, _ := zw.Create(member.name)
+		w.Write([]byte(member.data))
+	}
+	zw.Close()
+	upload("docs.zip", "columns=animal", zipped.Bytes())
+	leader.ReadLine(t)
+	player.ReadLine(t)
+	player.SendRandomWord(t, testGame.tag, "zebra")
+	leader.ReadLine(t)
+	player.ReadLine(t)
+	// equally close to a count of 8
+	leader.SendGuessCount(t, testGame.tag, 7)
+	player.SendGuessCount(t, testGame.tag, 9)
+	resp = leader.ReadLine(t)
+	if resp != fmt.Sprintf("Congratulations you share the win with %s!", player.name) {
+		t.Fatalf("Incorrect count of a word in structured documents: %s", resp)
+	}
+
+	testGame.server.CleanUp(t)
+}
+
+func TestFinal_Indexing(t *testing.T) {
+	// plain text is streamed a word at a time, even without line breaks
+	pieces := make([]string, 0)
+	err := documentText(strings.NewReader(strings.Repeat("word\t", 100000)+"last"), FORMAT_TEXT, "", func(text string) {
+		pieces = append(pieces, text)
+	})
+	if err != nil || len(pieces) != 100001 || pieces[0] != "word" || pieces[100000] != "last" {
+		t.Fatalf("Incorrect pieces of a text without line breaks: %d, %v", len(pieces), err)
+	}
+
+	directory := t.TempDir() + "/"
+	testGame := &TestGame{
+		players:     make([]*TestPlayer, 0),
+		server:      NewTestServerAt(t, directory),
+		playerCount: 2,
+	}
+	testGame.GameSetup(t)
+	leader := testGame.players[0]
+	player := testGame.players[1]
+	testGame.OpenGame(t, "min=2 ties=shared")
+	leader.SendStartGame(t, testGame.tag)
+	leader.ReadLine(t)
+	player.ReadLine(t)
+
+	data := []byte("<p>zebra</p><script>zebra</script> zebra\nzebra")
+	leader.conn.Write([]byte(fmt.Sprintf("FILE_UPLOAD %s zebras.html %d ", testGame.tag, len(data))))
+	leader.conn.Write(append(data, '\n'))
+	leader.ReadLine(t)
+	player.ReadLine(t)
+	player.SendRandomWord(t, testGame.tag, "zebra")
+	leader.ReadLine(t)
+	player.ReadLine(t)
+
+	// the counts are saved once the picker is asked for a word
+	index := directory + testGame.tag + "/" + IndexFilePrefix + "zebras.html"
+	saved, err := os.ReadFile(index)
+	if err != nil || !strings.Contains(string(saved), "\n3 zebra\n") {
+		t.Fatalf("Incorrect index of the upload: %q %v", saved, err)
+	}
+	testGame.server.gameServer.Close()
+	for _, p := range testGame.players {
+		p.Close()
+	}
+
+	// a recovered game reads the index instead of counting again
+	os.WriteFile(index, []byte(strings.Replace(string(saved), "\n3 zebra\n", "\n5 zebra\n", 1)), 0644)
+	testGame.server = NewTestServerAt(t, directory)
+	for _, p := range testGame.players {
+		p.conn = testGame.server.Connect(t)
+		p.SendHello(t)
+		p.ReadResponse(t)
+	}
+	leader.SendGuessCount(t, testGame.tag, 4)
+	player.SendGuessCount(t, testGame.tag, 6)
+	resp := leader.ReadLine(t)
+	if resp != fmt.Sprintf("Congratulations you share the win with %s!", player.name) {
+		t.Fatalf("Recovered game did not use the saved index: %s", resp)
+	}
+
+	testGame.server.CleanUp(t)
+}
+
+func TestFinal_CorpusLibrary(t *testing.T) {
+	directory := t.TempDir() + "/"
+	testGame := &TestGame{
+		players:     make([]*TestPlayer, 0),
+		server:      NewTestServerAt(t, directory),
+		playerCount: 2,
+	}
+	testGame.GameSetup(t)
+	leader := testGame.players[0]
+	player := testGame.players[1]
+	send := func(tp *TestPlayer, cmd string) string {
+		tp.conn.Write([]byte(cmd + "\n"))
+		return tp.ReadLine(t)
+	}
+	newGame := func(tag string) {
+		leader.SendNewGame(t, tag+" min=2")
+		leader.ReadResponse(t)
+		player.SendJoinGame(t, tag)
+		player.ReadResponse(t)
+		leader.ReadResponse(t)
+		leader.SendStartGame(t, tag)
+		leader.ReadLine(t)
+		player.ReadLine(t)
+	}
+	objects := func() int {
+		entries, _ := os.ReadDir(directory + LibraryDirectoryName + "objects/")
+		return len(entries)
+	}
+
+	first, second := randSeq(6), randSeq(6)
+	newGame(first)
+	contents := "zebra lion zebra\n"
+	leader.conn.Write([]byte(fmt.Sprintf("FILE_UPLOAD %s words.txt save=words.txt %d %s\n", first, len(contents), contents)))
+	leader.ReadLine(t)
+	player.ReadLine(t)
+	resp := send(player, "LIST_CORPORA")
+	if resp != fmt.Sprintf("Corpora in the library: words.txt (%d bytes).", len(contents)) {
+		t.Fatalf("Incorrect response to LIST_CORPORA: %s", resp)
+	}
+	leader.SendClose(t, first)
+	leader.ReadLine(t)
+	player.ReadLine(t)
+
+	// the corpus outlives its game and the server
+	testGame.server.gameServer.Close()
+	testGame.server = NewTestServerAt(t, directory)
+	for _, p := range testGame.players {
+		p.Close()
+		p.conn = testGame.server.Connect(t)
+		p.SendHello(t)
+		p.ReadLine(t)
+	}
+	newGame(second)
+	other := "horse\n"
+	resp = send(leader, fmt.Sprintf("FILE_UPLOAD %s other.txt save=words.txt %d %s", second, len(other), other))
+	if resp != "The library already has a different corpus named words.txt." {
+		t.Fatalf("Incorrect response to saving a different corpus under a taken name: %s", resp)
+	}
+	resp = send(player, fmt.Sprintf("USE_CORPUS %s words.txt", second))
+	if resp != fmt.Sprintf("Only the leader can upload the file. Please contact %s.", leader.name) {
+		t.Fatalf("Incorrect response to USE_CORPUS by a non-leader: %s", resp)
+	}
+	resp = send(leader, fmt.Sprintf("USE_CORPUS %s ../../../etc/passwd", second))
+	if resp != "Invalid file name, it may not start with a dot or contain slashes." {
+		t.Fatalf("Incorrect response to USE_CORPUS outside the game's directory: %s", resp)
+	}
+	resp = send(leader, fmt.Sprintf("USE_CORPUS %s nope.txt", second))
+	if resp != "No corpus named nope.txt in the library. Send LIST_CORPORA to see them." {
+		t.Fatalf("Incorrect response to USE_CORPUS of an unknown corpus: %s", resp)
+	}
+	leader.conn.Write([]byte(fmt.Sprintf("USE_CORPUS %s words.txt\n", second)))
+	resp = player.ReadLine(t)
+	if resp != "Upload completed! Please select a word from words.txt." {
+		t.Fatalf("Incorrect notification after USE_CORPUS: %s", resp)
+	}
+	leader.ReadLine(t)
+	stored, err := ioutil.ReadFile(directory + second + "/words.txt")
+	if err != nil || string(stored) != contents {
+		t.Fatalf("The corpus was not put in the game directory: %v", err)
+	}
+	resp = send(leader, fmt.Sprintf("USE_CORPUS %s words.txt", second))
+	if resp != fmt.Sprintf("Game %s takes the file once it is running and until the word is picked.", second) {
+		t.Fatalf("Incorrect response to USE_CORPUS while picking: %s", resp)
+	}
+	leader.SendClose(t, second)
+	leader.ReadLine(t)
+	player.ReadLine(t)
+	if n := objects(); n != 1 {
+		t.Fatalf("The library should keep one file, it has %d", n)
+	}
+
+	testGame.server.gameServer.Close()
+}
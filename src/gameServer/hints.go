@@ -0,0 +1,122 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// The picker may ask for HINTS: candidate words of the upload, a few from
+// each of three frequency bands, the rarest third of the words, the middle
+// third and the most frequent third. Candidates follow the pick rules of
+// the game, so every hint is a word RANDOM_WORD accepts:
+//
+//	minLength=<n>     words shorter than n letters are refused
+//	minCount=<n>      words counted fewer than n times are refused
+//	maxCount=<n>      words counted more than n times are refused, 0 for no limit
+//	stopWords=<list>  words of the list are refused, "english" for the common
+//	                  English words below, or words separated by commas
+
+// STOP_WORDS_ENGLISH names the built-in list of stop words
+const STOP_WORDS_ENGLISH string = "english"
+
+// hint bands, from the rarest words to the most frequent
+var hintBands = []string{"rare", "medium", "frequent"}
+
+var englishStopWords = strings.Fields(`a about after all also an and any are as at be because been but by can could
+	did do does for from had has have he her his how i if in into is it its just me more my no not of on one or our out
+	she so some than that the their them then there these they this to up us was we were what when which who will with
+	would you your`)
+
+// stopWords returns the stop words of the rules, in lower case
+func (rules gameRules) stopList() map[string]bool {
+	words := make(map[string]bool)
+	if rules.stopWords == "" {
+		return words
+	}
+	list := strings.Split(rules.stopWords, ",")
+	if rules.stopWords == STOP_WORDS_ENGLISH {
+		list = englishStopWords
+	}
+	for _, word := range list {
+		words[strings.ToLower(word)] = true
+	}
+	return words
+}
+
+// pickable returns why the pick rules refuse a word of wordDict, or "" if
+// the picker may choose it
+func (game *Game) pickable(word string, stopWords map[string]bool) string {
+	count := game.wordDict[word]
+	switch {
+	case utf8.RuneCountInString(word) < game.rules.minLength:
+		return "too short"
+	case stopWords[strings.ToLower(word)]:
+		return "stop word"
+	case count < game.rules.minCount:
+		return "too rare"
+	case game.rules.maxCount > 0 && count > game.rules.maxCount:
+		return "too common"
+	}
+	return ""
+}
+
+// candidates returns the unused words the pick rules allow, from the rarest
+// to the most frequent, words counted the same in alphabetical order
+func (game *Game) candidates() []string {
+	stopWords := game.rules.stopList()
+	candidates := make([]string, 0)
+	for word := range game.wordDict {
+		if _, used := game.usedWords[word]; !used && game.pickable(word, stopWords) == "" {
+			candidates = append(candidates, word)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		ci, cj := game.wordDict[candidates[i]], game.wordDict[candidates[j]]
+		return ci < cj || ci == cj && candidates[i] < candidates[j]
+	})
+	return candidates
+}
+
+// hints picks up to HINT_WORDS candidates of each band, the words of a band
+// are under its name, separated by spaces. The counts are left out, the
+// picker guesses too.
+func (game *Game) hints() map[string]string {
+	candidates := game.candidates()
+	resp := map[string]string{"status": "success", "bands": strings.Join(hintBands, ",")}
+	for i, band := range hintBands {
+		words := candidates[i*len(candidates)/len(hintBands) : (i+1)*len(candidates)/len(hintBands)]
+		sample := make([]string, 0, HINT_WORDS)
+		for _, j := range rand.Perm(len(words)) {
+			if len(sample) == HINT_WORDS {
+				break
+			}
+			sample = append(sample, words[j])
+		}
+		sort.Strings(sample)
+		resp[band] = strings.Join(sample, " ")
+	}
+	return resp
+}
+
+// serverPick chooses the words of the round in games where the server
+// picks. With a seed the choice depends only on the seed, the round and the
+// words of the file, so a game replayed with the same seed and files picks
+// the same words, restarts of the server included. It returns nil when the
+// pick rules leave too few words.
+func (game *Game) serverPick() []string {
+	candidates := game.candidates()
+	if len(candidates) < game.rules.words {
+		return nil
+	}
+	perm := rand.Perm
+	if game.rules.seed != 0 {
+		perm = rand.New(rand.NewSource(game.rules.seed*1000003 + int64(game.round))).Perm
+	}
+	words := make([]string, 0, game.rules.words)
+	for _, i := range perm(len(candidates))[:game.rules.words] {
+		words = append(words, candidates[i])
+	}
+	return words
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The words of an upload are counted by a routine of their own, so a large
+// file does not hold up the game: players keep chatting, watching and
+// leaving while the picker waits for the counts. The files are streamed,
+// see formats.go, and the counts are saved next to them, so a game that
+// is recovered after a restart reads them instead of counting again.
+
+// IndexFilePrefix is prepended to the name of an upload to name its index
+const IndexFilePrefix string = ".index-"
+
+// indexKey tells whether a saved index still matches the upload, the same
+// files counted the same way
+type indexKey struct {
+	Files     []string `json:"files"`
+	Format    string   `json:"format"`
+	Columns   string   `json:"columns"`
+	Tokenizer string   `json:"tokenizer"`
+}
+
+func (game *Game) indexKey() indexKey {
+	return indexKey{Files: game.files, Format: game.format, Columns: game.columns, Tokenizer: game.rules.tokenizer}
+}
+
+func (game *Game) indexPath() string {
+	return game.directory + IndexFilePrefix + game.fileName
+}
+
+// startIndexing counts the words of the upload in the background, the
+// counts arrive on game.indexing
+func (game *Game) startIndexing() {
+	indexing := make(chan map[string]int, 1) // the game may be gone by the time the counts are ready
+	directory, path, key := game.directory, game.indexPath(), game.indexKey()
+	tokenizer := game.rules.Tokenizer()
+	go func() {
+		indexing <- buildIndex(directory, path, key, tokenizer)
+	}()
+	game.indexing = indexing
+}
+
+// indexed adds the counts of an upload to wordDict
+func (game *Game) indexed(counts map[string]int) {
+	for word, count := range counts {
+		game.wordDict[word] += count
+	}
+}
+
+// buildIndex reads the saved index at path, or counts the files and saves
+// the index there
+func buildIndex(directory string, path string, key indexKey, tokenizer Tokenizer) map[string]int {
+	if counts, ok := readIndex(path, key); ok {
+		return counts
+	}
+	counts := make(map[string]int)
+	for _, file := range key.Files {
+		fd, err := os.Open(directory + file)
+		if err != nil {
+			fmt.Printf("error: cannot open %s\n", directory+file)
+			continue
+		}
+		err = documentText(fd, documentFormat(file, key.Format), key.Columns, func(text string) {
+			for _, word := range tokenizer.Tokens(text) {
+				counts[word]++
+			}
+		})
+		fd.Close()
+		if err != nil {
+			// count what could be read
+			fmt.Printf("error: cannot read all of %s: %v\n", directory+file, err)
+		}
+	}
+	writeIndex(path, key, counts)
+	return counts
+}
+
+// An index file starts with its key as JSON, followed by one "<count> <word>"
+// line per word. Tokens never hold white space, so a word is the rest of
+// its line.
+func writeIndex(path string, key indexKey, counts map[string]int) {
+	temp := path + ".tmp"
+	fd, err := os.Create(temp)
+	if err != nil {
+		fmt.Printf("error: cannot write %s: %v\n", path, err)
+		return
+	}
+	writer := bufio.NewWriter(fd)
+	header, _ := json.Marshal(key)
+	writer.Write(append(header, '\n'))
+	for word, count := range counts {
+		writer.WriteString(strconv.Itoa(count) + " " + word + "\n")
+	}
+	if err := writer.Flush(); err != nil {
+		fd.Close()
+		os.Remove(temp)
+		return
+	}
+	fd.Close()
+	os.Rename(temp, path)
+}
+
+func readIndex(path string, key indexKey) (map[string]int, bool) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, false
+	}
+	defer fd.Close()
+	reader := bufio.NewReader(fd)
+	header, err := reader.ReadBytes('\n')
+	if err != nil {
+		return nil, false
+	}
+	var saved indexKey
+	if json.Unmarshal(header, &saved) != nil || !saved.equal(key) {
+		return nil, false
+	}
+	counts := make(map[string]int)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			// every line ends with a line break, the file is complete
+			return counts, line == ""
+		}
+		count, word, ok := strings.Cut(strings.TrimSuffix(line, "\n"), " ")
+		n, convErr := strconv.Atoi(count)
+		if !ok || convErr != nil {
+			return nil, false
+		}
+		counts[word] = n
+	}
+}
+
+func (key indexKey) equal(other indexKey) bool {
+	return strings.Join(key.Files, ",") == strings.Join(other.Files, ",") && key.Format == other.Format &&
+		key.Columns == other.Columns && key.Tokenizer == other.Tokenizer
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// JournalFileName is the write-ahead journal kept in every game directory.
+// Each line is one event, a JSON object with an "event" key, e.g.
+// {"event": "join", "name": "playerOne"}. Events are appended before the
+// game acts on them, so replaying the journal after a crash rebuilds the
+// game exactly as its players last saw it.
+const JournalFileName string = ".journal"
+
+// open (or create) the journal of this game for appending
+func (game *Game) openJournal() {
+	fd, err := os.OpenFile(game.directory+JournalFileName, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		fmt.Printf("error: cannot open the journal of game %s: %v\n", game.gameID, err)
+		return
+	}
+	game.journal = fd
+}
+
+// record appends an event to the journal and flushes it to disk
+func (game *Game) record(event string, fields map[string]string) {
+	if game.journal == nil {
+		return
+	}
+	entry := map[string]string{"event": event}
+	for k, v := range fields {
+		entry[k] = v
+	}
+	line, _ := json.Marshal(entry)
+	if _, err := game.journal.Write(append(line, '\n')); err != nil {
+		fmt.Printf("error: cannot write the journal of game %s: %v\n", game.gameID, err)
+		return
+	}
+	game.journal.Sync()
+}
+
+func (game *Game) closeJournal() {
+	if game.journal != nil {
+		game.journal.Close()
+		game.journal = nil
+	}
+}
+
+// readJournal returns the events of a journal. A torn last line, left by a
+// crash in the middle of a write, is ignored.
+func readJournal(path string) ([]map[string]string, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	entries := make([]map[string]string, 0)
+	reader := bufio.NewReader(fd)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			// EOF, possibly after a partial line
+			break
+		}
+		entry := make(map[string]string)
+		if json.Unmarshal(line, &entry) != nil {
+			break
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// recoverGames rebuilds every game that has a journal in the storage directory,
+// together with the players that belong to them. Every player starts out
+// disconnected and resumes the game with HELLO.
+func (server *GameServer) recoverGames() error {
+	dirs, err := os.ReadDir(server.directory)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		gameID := dir.Name()
+		entries, err := readJournal(server.directory + gameID + "/" + JournalFileName)
+		if err != nil || len(entries) == 0 || entries[0]["event"] != "create" {
+			continue
+		}
+		rules, err := parseRules(strings.Fields(entries[0]["rules"]))
+		if err != nil {
+			fmt.Printf("error: invalid rules in the journal of game %s: %v\n", gameID, err)
+			continue
+		}
+		game := server.allocGame(gameID, entries[0]["leader"], rules)
+		game.namesOrd[game.leader] = 0
+		// every member replays as disconnected, mailboxes are filled in below
+		game.namesDisconn[game.leader] = nil
+		closed := false
+		for _, entry := range entries[1:] {
+			if entry["event"] == "close" {
+				closed = true
+				break
+			}
+			game.replay(entry)
+		}
+		if closed {
+			// crashed while closing the game
+			os.RemoveAll(game.directory)
+			continue
+		}
+		for name := range game.namesDisconn {
+			player, ok := server.players[name]
+			if !ok {
+				player = server.newPlayer(name)
+			}
+			player.gameIDs[gameID] = game.mailbox
+			game.namesDisconn[name] = player.mailbox
+		}
+		if game.state != RUNNING {
+			game.changeState()
+		}
+		// deadlines start over
+		if game.state == RUNNING && game.picker != "" && game.tgtWords == nil {
+			game.armPickDeadline()
+		}
+		if game.waitingForGuess {
+			game.armGuessDeadline()
+		}
+		server.games[gameID] = game
+		game.openJournal()
+		if game.state == RUNNING && game.rules.picker == PICKER_SERVER && game.fileName != "" && game.tgtWords == nil {
+			// went down between the upload and the pick
+			game.pickForServer()
+		}
+		// Run starts the routine
+	}
+	return nil
+}
+
+// replay applies one journal event to a game that is not running yet
+func (game *Game) replay(entry map[string]string) {
+	switch entry["event"] {
+	case "join":
+		game.namesDisconn[entry["name"]] = nil
+		game.namesOrd[entry["name"]] = len(game.namesOrd)
+	case "leave":
+		delete(game.namesDisconn, entry["name"])
+	case "leader":
+		game.leader = entry["name"]
+	case "start":
+		game.state = RUNNING
+	case "upload_begin":
+		game.resumeUpload(entry)
+	case "upload":
+		game.upload = nil
+		game.fileName = entry["filename"]
+		game.files = []string{game.fileName}
+		if entry["files"] != "" {
+			game.files = strings.Split(entry["files"], ",")
+		}
+		game.format, game.columns = entry["format"], entry["columns"]
+		game.picker = entry["picker"]
+		// the game routine is not running yet, and the saved index makes this quick
+		game.indexed(buildIndex(game.directory, game.indexPath(), game.indexKey(), game.rules.Tokenizer()))
+	case "picker":
+		game.picker = entry["name"]
+	case "pick":
+		game.tgtWords = strings.Fields(entry["word"])
+		game.waitingForGuess = true
+	case "guess":
+		guess, _ := parseGuess(entry["guess"])
+		game.addGuess(entry["name"], guess)
+	case "winner":
+		game.waitingForGuess = false
+		game.scoreRound(game.actualCounts())
+		game.round++
+	case "restart":
+		game.state = WAITING
+		game.picker = ""
+		game.fileName = ""
+		for _, word := range game.tgtWords {
+			game.usedWords[word] = true
+		}
+		game.tgtWords = nil
+		game.waitingForGuess = false
+		game.guessResults = make(map[string][]int)
+		game.guessOrder = nil
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// The corpus library keeps files for every game to use, so a corpus is
+// uploaded once with the "save=<name>" option and then picked by name with
+// USE_CORPUS. Files are stored by their sha256, so a corpus saved under
+// two names is stored once. Every stored file is held by the names that
+// point to it and by the games that use it, and is deleted when the last
+// of them lets go. The library lives in the storage directory and survives
+// closed games and restarts of the server.
+//
+// Only the server routine touches the library, games, players and the
+// admin socket send it a libraryRequest.
+
+// LibraryDirectoryName is the library in the storage directory, the dot
+// keeps it apart from the game directories
+const LibraryDirectoryName string = ".library/"
+
+// corpusEntry is a named corpus in the library
+type corpusEntry struct {
+	Name   string `json:"name"`
+	Sha256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+type corpusLibrary struct {
+	directory string                 // the library directory
+	Corpora   map[string]corpusEntry `json:"corpora"` // by name
+	Holders   map[string][]string    `json:"holders"` // by sha256, "corpus:<name>" and "game:<gameID>"
+}
+
+// libraryRequest asks the server routine to act on the library
+type libraryRequest struct {
+	op     string // "add", "use", "release", "list" or "remove"
+	name   string // corpus name
+	holder string // "game:<gameID>" for use and release
+	path   string // file to add
+	sha256 string // of the file to add
+	size   int64
+	reply  chan libraryResponse
+}
+
+type libraryResponse struct {
+	corpus  corpusEntry
+	path    string        // where the file of the corpus is stored
+	corpora []corpusEntry // for list, sorted by name
+	reason  string        // "" on success
+}
+
+// openLibrary loads the library in a storage directory, creating it if
+// there is none yet
+func openLibrary(storage string) *corpusLibrary {
+	library := &corpusLibrary{
+		directory: storage + LibraryDirectoryName,
+		Corpora:   make(map[string]corpusEntry),
+		Holders:   make(map[string][]string),
+	}
+	os.MkdirAll(library.directory+"objects/", os.ModePerm)
+	data, err := os.ReadFile(library.directory + "index.json")
+	if err == nil {
+		if err := json.Unmarshal(data, library); err != nil {
+			fmt.Printf("error: cannot read the corpus library: %v\n", err)
+		}
+	}
+	return library
+}
+
+// save writes the index, through a temp file so a crash leaves the old one
+func (library *corpusLibrary) save() {
+	data, _ := json.Marshal(library)
+	temp := library.directory + "index.json.tmp"
+	if err := os.WriteFile(temp, data, 0644); err != nil {
+		fmt.Printf("error: cannot write the corpus library: %v\n", err)
+		return
+	}
+	os.Rename(temp, library.directory+"index.json")
+}
+
+func (library *corpusLibrary) objectPath(sum string) string {
+	return library.directory + "objects/" + sum
+}
+
+func (library *corpusLibrary) serve(req libraryRequest) libraryResponse {
+	switch req.op {
+	case "add":
+		return library.add(req)
+	case "use":
+		entry, ok := library.Corpora[req.name]
+		if !ok {
+			return libraryResponse{reason: "no corpus"}
+		}
+		library.hold(entry.Sha256, req.holder)
+		library.save()
+		return libraryResponse{corpus: entry, path: library.objectPath(entry.Sha256)}
+	case "release":
+		released := false
+		for sum := range library.Holders {
+			released = library.drop(sum, req.holder) || released
+		}
+		if released {
+			library.save()
+		}
+	case "remove":
+		entry, ok := library.Corpora[req.name]
+		if !ok {
+			return libraryResponse{reason: "no corpus"}
+		}
+		delete(library.Corpora, req.name)
+		library.drop(entry.Sha256, "corpus:"+req.name)
+		library.save()
+	case "list":
+		corpora := make([]corpusEntry, 0, len(library.Corpora))
+		for _, entry := range library.Corpora {
+			corpora = append(corpora, entry)
+		}
+		sort.Slice(corpora, func(i, j int) bool { return corpora[i].Name < corpora[j].Name })
+		return libraryResponse{corpora: corpora}
+	}
+	return libraryResponse{}
+}
+
+// add saves a file under a name. Saving the same file under the same name
+// again does nothing, a different file needs a different name.
+func (library *corpusLibrary) add(req libraryRequest) libraryResponse {
+	if entry, ok := library.Corpora[req.name]; ok {
+		if entry.Sha256 != req.sha256 {
+			return libraryResponse{reason: "corpus exists"}
+		}
+		return libraryResponse{corpus: entry, path: library.objectPath(entry.Sha256)}
+	}
+	object := library.objectPath(req.sha256)
+	if _, err := os.Stat(object); err != nil {
+		if err := linkOrCopy(req.path, object); err != nil {
+			return libraryResponse{reason: "write failed"}
+		}
+	}
+	entry := corpusEntry{Name: req.name, Sha256: req.sha256, Size: req.size}
+	library.Corpora[req.name] = entry
+	library.hold(req.sha256, "corpus:"+req.name)
+	library.save()
+	return libraryResponse{corpus: entry, path: object}
+}
+
+func (library *corpusLibrary) hold(sum string, holder string) {
+	for _, h := range library.Holders[sum] {
+		if h == holder {
+			return
+		}
+	}
+	library.Holders[sum] = append(library.Holders[sum], holder)
+}
+
+// drop lets go of a file, deleting it when nothing holds it any more. It
+// returns whether the holder held the file.
+func (library *corpusLibrary) drop(sum string, holder string) bool {
+	holders := library.Holders[sum]
+	found := false
+	for i, h := range holders {
+		if h == holder {
+			holders = append(holders[:i], holders[i+1:]...)
+			found = true
+			break
+		}
+	}
+	if len(holders) > 0 {
+		library.Holders[sum] = holders
+		return found
+	}
+	delete(library.Holders, sum)
+	os.Remove(library.objectPath(sum))
+	return found
+}
+
+// linkOrCopy puts a file at target, as a hard link where the file system
+// allows it
+func linkOrCopy(source string, target string) error {
+	if os.Link(source, target) == nil {
+		return nil
+	}
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(target)
+		return err
+	}
+	return out.Close()
+}
+
+// libraryCall sends a request to the server routine and waits for the answer
+func (server *GameServer) libraryCall(req libraryRequest) libraryResponse {
+	req.reply = make(chan libraryResponse)
+	select {
+	case server.chanLibraryReq <- req:
+		return <-req.reply
+	case <-server.stopping:
+		return libraryResponse{reason: "shutting down"}
+	}
+}
+
+// saveCorpus adds a file of the game directory to the library
+func (game *Game) saveCorpus(name string, fileName string) string {
+	fd, err := os.Open(game.directory + fileName)
+	if err != nil {
+		return "write failed"
+	}
+	hash := sha256.New()
+	size, err := io.Copy(hash, fd)
+	fd.Close()
+	if err != nil {
+		return "write failed"
+	}
+	resp := game.server.libraryCall(libraryRequest{op: "add", name: name, path: game.directory + fileName,
+		sha256: hex.EncodeToString(hash.Sum(nil)), size: size})
+	return resp.reason
+}
+
+// useCorpus puts a corpus of the library into the game directory, the game
+// holds it until it is closed
+func (game *Game) useCorpus(name string) string {
+	if _, err := os.Stat(game.directory + name); err == nil {
+		return "file exists"
+	}
+	resp := game.server.libraryCall(libraryRequest{op: "use", name: name, holder: "game:" + game.gameID})
+	if resp.reason != "" {
+		return resp.reason
+	}
+	if err := linkOrCopy(resp.path, game.directory+name); err != nil {
+		return "write failed"
+	}
+	return ""
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The lobby tells players which games there are, so they need not know a
+// tag to join:
+//
+//	LIST_GAMES                  the open games, waiting or ready for players
+//	LIST_GAMES state=RUNNING    the games in any of the comma separated states
+//	LIST_GAMES free=2           the games with at least two free seats
+//	LIST_GAMES leader=alice     the games led by alice
+//
+// WATCH_LOBBY subscribes to the lobby: the player is told whenever a game
+// opens, because it was created or a seat came free, and whenever an open
+// game fills up, starts or is closed. UNWATCH_LOBBY or a disconnection ends
+// the subscription.
+//
+// Every game routine publishes a lobbyEntry when it changes, the server
+// routine keeps the latest entry of every game and serves the lobby from
+// them, so no game is asked anything while a player waits.
+
+// lobbyEntry is what the lobby knows of a game
+type lobbyEntry struct {
+	gameID  string
+	state   GameState
+	leader  string
+	players int // seats taken, by disconnected players too
+	seats   int // the "max" rule
+}
+
+// open tells whether players may join the game
+func (entry lobbyEntry) open() bool {
+	return entry.state == WAITING || entry.state == READY
+}
+
+// free returns the number of free seats
+func (entry lobbyEntry) free() int {
+	if entry.players >= entry.seats {
+		return 0
+	}
+	return entry.seats - entry.players
+}
+
+func (entry lobbyEntry) fields() map[string]interface{} {
+	return map[string]interface{}{"gameID": entry.gameID, "state": string(entry.state), "leader": entry.leader,
+		"players": entry.players, "seats": entry.seats}
+}
+
+func (entry lobbyEntry) String() string {
+	return fmt.Sprintf("%s, %d of %d players, leader %s", entry.state, entry.players, entry.seats, entry.leader)
+}
+
+// lobbyFilter selects the games of a LIST_GAMES
+type lobbyFilter struct {
+	states map[GameState]bool
+	free   int
+	leader string // "" for any
+}
+
+// parseLobbyFilter reads the options of a LIST_GAMES
+func parseLobbyFilter(options []string) (lobbyFilter, bool) {
+	filter := lobbyFilter{states: map[GameState]bool{WAITING: true, READY: true}}
+	for _, option := range options {
+		key, value, ok := strings.Cut(option, "=")
+		if !ok || value == "" {
+			return filter, false
+		}
+		switch key {
+		case "state":
+			filter.states = make(map[GameState]bool)
+			for _, state := range strings.Split(strings.ToUpper(value), ",") {
+				switch GameState(state) {
+				case WAITING, READY, FULL, RUNNING:
+					filter.states[GameState(state)] = true
+				default:
+					return filter, false
+				}
+			}
+		case "free":
+			free, err := strconv.Atoi(value)
+			if err != nil || free < 0 {
+				return filter, false
+			}
+			filter.free = free
+		case "leader":
+			filter.leader = value
+		default:
+			return filter, false
+		}
+	}
+	return filter, true
+}
+
+func (filter lobbyFilter) match(entry lobbyEntry) bool {
+	return filter.states[entry.state] && entry.free() >= filter.free &&
+		(filter.leader == "" || filter.leader == entry.leader)
+}
+
+// lobbyRequest asks the server routine to act on the lobby
+type lobbyRequest struct {
+	op     string // "update" from a game, "list", "watch" or "unwatch" from a player
+	entry  lobbyEntry
+	filter lobbyFilter
+	name   string                 // the player of watch and unwatch
+	news   chan map[string]string // where a watching player is told, see Player.lobby
+	reply  chan []lobbyEntry      // for list, sorted by gameID
+}
+
+// serveLobby is called by the server routine
+func (server *GameServer) serveLobby(req lobbyRequest) {
+	switch req.op {
+	case "update":
+		before, known := server.lobby[req.entry.gameID]
+		server.lobby[req.entry.gameID] = req.entry
+		switch {
+		case req.entry.open() && (!known || !before.open()):
+			server.lobbyNews(req.entry, "GAME_OPEN")
+		case req.entry.state == FULL && known && before.open():
+			server.lobbyNews(req.entry, "GAME_FULL")
+		case req.entry.state == RUNNING && known && before.open():
+			server.lobbyNews(req.entry, "GAME_STARTED")
+		}
+	case "list":
+		entries := make([]lobbyEntry, 0)
+		for _, entry := range server.lobby {
+			if req.filter.match(entry) {
+				entries = append(entries, entry)
+			}
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].gameID < entries[j].gameID })
+		req.reply <- entries
+	case "watch":
+		server.lobbyWatchers[req.name] = req.news
+	case "unwatch":
+		delete(server.lobbyWatchers, req.name)
+	}
+}
+
+// unlist removes a game that is cleaned up from the lobby
+func (server *GameServer) unlist(gameID string) {
+	if entry, known := server.lobby[gameID]; known && entry.open() {
+		server.lobbyNews(entry, "GAME_CLOSED")
+	}
+	delete(server.lobby, gameID)
+}
+
+// lobbyNews tells the watching players about a game. The news channels are
+// buffered, a player that does not keep up misses news rather than hold up
+// the server.
+func (server *GameServer) lobbyNews(entry lobbyEntry, msg string) {
+	news := map[string]string{
+		"gameID":  entry.gameID,
+		"msg":     msg,
+		"state":   string(entry.state),
+		"leader":  entry.leader,
+		"players": strconv.Itoa(entry.players),
+		"seats":   strconv.Itoa(entry.seats),
+	}
+	for _, watcher := range server.lobbyWatchers {
+		select {
+		case watcher <- news:
+		default:
+		}
+	}
+}
+
+// listGames asks the server routine for the games of a LIST_GAMES
+func (server *GameServer) listGames(filter lobbyFilter) []lobbyEntry {
+	req := lobbyRequest{op: "list", filter: filter, reply: make(chan []lobbyEntry)}
+	server.chanLobbyReq <- req
+	return <-req.reply
+}
+
+// publish tells the lobby about the game if anything it shows changed. The
+// game routine calls it before it waits for the next mail.
+func (game *Game) publish() {
+	entry := lobbyEntry{
+		gameID:  game.gameID,
+		state:   game.state,
+		leader:  game.leader,
+		players: len(game.names) + len(game.namesDisconn),
+		seats:   game.rules.maxPlayers,
+	}
+	if entry == game.listed {
+		return
+	}
+	game.listed = entry
+	select {
+	case game.server.chanLobbyReq <- lobbyRequest{op: "update", entry: entry}:
+	case <-game.server.stopping:
+		// shutting down, nobody looks at the lobby any more
+	}
+}
+
+// newLobbyEntry reads a lobby notification back
+func newLobbyEntry(news map[string]string) lobbyEntry {
+	players, _ := strconv.Atoi(news["players"])
+	seats, _ := strconv.Atoi(news["seats"])
+	return lobbyEntry{gameID: news["gameID"], state: GameState(news["state"]), leader: news["leader"],
+		players: players, seats: seats}
+}
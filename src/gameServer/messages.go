@@ -1,152 +1,805 @@
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// message is a single message sent to a client. Text clients receive text,
+// JSON clients receive kind, event and fields as one JSON object.
+type message struct {
+	kind   string                 // "response", "error" or "notification"
+	event  string                 // stable name of the event, e.g. GAME_CREATED
+	fields map[string]interface{} // event specific fields
+	text   string                 // text protocol rendering, may be empty
+}
+
+// tagged prefixes every line of the text with the tag of the game the
+// message is about, for players in several games
+func (m message) tagged() message {
+	gameID, _ := m.fields["gameID"].(string)
+	tag := "[" + gameID + "] "
+	if gameID == "" || m.text == "" || strings.HasPrefix(m.text, tag) {
+		// chat is always tagged
+		return m
+	}
+	text := strings.TrimSuffix(m.text, "\n")
+	m.text = tag + strings.ReplaceAll(text, "\n", "\n"+tag) + m.text[len(text):]
+	return m
+}
+
+func newResponse(event string, fields map[string]interface{}, text string) message {
+	return message{kind: "response", event: event, fields: fields, text: text}
+}
+
+func newError(event string, fields map[string]interface{}, text string) message {
+	return message{kind: "error", event: event, fields: fields, text: text}
+}
+
+func newNotification(event string, fields map[string]interface{}, text string) message {
+	return message{kind: "notification", event: event, fields: fields, text: text}
+}
 
 // normal status messages
 
-func msgWelcome(username string, gameID string, gameState string) string {
+// msgWelcome carries the session token to JSON clients, text clients ask
+// for it with SESSION
+func msgWelcome(username string, gameID string, gameState string, session string) message {
 	if gameState == "" {
 		// new player
-		return fmt.Sprintf("Welcome to Word Count %s! Do you want to create a new game or join an existing game?\n", username)
+		return newResponse("WELCOME", map[string]interface{}{"name": username, "session": session},
+			fmt.Sprintf("Welcome to Word Count %s! Do you want to create a new game or join an existing game?\n", username))
+	}
+	return newResponse("WELCOME", map[string]interface{}{"name": username, "gameID": gameID, "state": gameState, "session": session},
+		fmt.Sprintf("Welcome to Word Count %s! Resumed Game %s. Current state is %s.\n", username, gameID, gameState))
+}
+
+func msgGameCreated(gameID string, rules gameRules) message {
+	return newResponse("GAME_CREATED", map[string]interface{}{"gameID": gameID, "rules": rules.fields()},
+		fmt.Sprintf("Game %s created! You are the leader of the game. Waiting for players to join.\n", gameID))
+}
+
+// msgGameJoined only spells out the rules if they differ from the defaults.
+func msgGameJoined(gameID string, state string, rules gameRules) message {
+	text := fmt.Sprintf("Joined Game %s. Current state is %s.\n", gameID, state)
+	if !rules.isDefault() {
+		text = fmt.Sprintf("Joined Game %s. Current state is %s. Rules: %s.\n", gameID, state, rules)
+	}
+	return newResponse("GAME_JOINED", map[string]interface{}{"gameID": gameID, "state": state, "rules": rules.fields()}, text)
+}
+
+func msgWatching(gameID string, state string) message {
+	return newResponse("WATCHING", map[string]interface{}{"gameID": gameID, "state": state},
+		fmt.Sprintf("Watching Game %s. Current state is %s.\n", gameID, state))
+}
+
+func msgPromoted(gameID string, state string) message {
+	return newNotification("PROMOTED", map[string]interface{}{"gameID": gameID, "state": state},
+		fmt.Sprintf("A seat opened up! Joined Game %s. Current state is %s.\n", gameID, state))
+}
+
+func msgGameReady(gameID string) message {
+	return newNotification("READY", map[string]interface{}{"gameID": gameID},
+		fmt.Sprintf("Game %s is ready to start.\n", gameID))
+}
+
+func msgGameStartedLeader(gameID string) message {
+	return newResponse("GAME_STARTED", map[string]interface{}{"gameID": gameID},
+		fmt.Sprintf("Game %s is running. Please upload the file.\n", gameID))
+}
+
+func msgGameStartedNonLeader(gameID string, leader string) message {
+	return newNotification("STARTED", map[string]interface{}{"gameID": gameID, "leader": leader},
+		fmt.Sprintf("Game %s has started. Waiting for %s to upload the file.\n", gameID, leader))
+}
+
+func msgFileUploadedNonPicker(gameID string) message {
+	return newNotification("UPLOADED", map[string]interface{}{"gameID": gameID},
+		"Upload completed! Waiting for word selection.\n")
+}
+
+// msgFileUploadedPicker asks the picker for a word, files lists what was
+// extracted when the upload is an archive
+func msgFileUploadedPicker(gameID string, fileName string, files string) message {
+	fields := map[string]interface{}{"gameID": gameID, "filename": fileName, "files": strings.Split(files, ",")}
+	if files == fileName {
+		return newNotification("PICK", fields, fmt.Sprintf("Upload completed! Please select a word from %s.\n", fileName))
+	}
+	return newNotification("PICK", fields,
+		fmt.Sprintf("Upload completed! Please select a word from %s (%s).\n", fileName, strings.ReplaceAll(files, ",", ", ")))
+}
+
+// msgNewLeader has no text for players other than the new leader.
+func msgNewLeader(gameID string, leader string, isLeader bool) message {
+	text := ""
+	if isLeader {
+		text = fmt.Sprintf("You are the new leader for game %s!\n", gameID)
+	}
+	return newNotification("NEW_LEADER", map[string]interface{}{"gameID": gameID, "leader": leader}, text)
+}
+
+// msgWordSet acknowledges a picked word, text clients only see WORD_SELECTED.
+func msgWordSet(gameID string, word string) message {
+	return newResponse("WORD_SET", map[string]interface{}{"gameID": gameID, "word": word}, "")
+}
+
+// msgWordSetSuccess announces the word of the round, or the words separated
+// by spaces with the "words" rule
+func msgWordSetSuccess(gameID string, word string) message {
+	words := strings.Fields(word)
+	fields := map[string]interface{}{"gameID": gameID, "word": word, "words": words}
+	if len(words) > 1 {
+		return newNotification("WORD_SELECTED", fields,
+			fmt.Sprintf("Words selected are %s! Guess the count of each word.\n", strings.Join(words, ", ")))
+	}
+	return newNotification("WORD_SELECTED", fields, fmt.Sprintf("Word selected is %s! Guess the word count.\n", word))
+}
+
+func msgWordSelectedSpectator(gameID string, word string) message {
+	words := strings.Fields(word)
+	fields := map[string]interface{}{"gameID": gameID, "word": word, "words": words}
+	if len(words) > 1 {
+		return newNotification("WORD_SELECTED", fields,
+			fmt.Sprintf("Words selected are %s! Waiting for the guesses.\n", strings.Join(words, ", ")))
+	}
+	return newNotification("WORD_SELECTED", fields, fmt.Sprintf("Word selected is %s! Waiting for the guesses.\n", word))
+}
+
+// msgGuessRecorded acknowledges a guess, text clients wait for WINNER.
+func msgGuessRecorded(gameID string, guess string) message {
+	return newResponse("GUESS_RECORDED", map[string]interface{}{"gameID": gameID, "guess": guess}, "")
+}
+
+// roundResult is the outcome of a round as told by a WINNER notification
+type roundResult struct {
+	gameID     string
+	winner     string     // the first winner, "" if nobody guessed
+	winners    []string   // everyone sharing the win
+	count      int        // actual count of the word, the first one with the "words" rule
+	words      []string   // target words of the round
+	counts     []int      // actual count of each target word
+	distances  []standing // how far off every guess was, closest first
+	round      int
+	final      bool // no rounds left
+	multiRound bool // whether text clients see the standings
+	standings  []standing
+}
+
+func newRoundResult(notification map[string]string) roundResult {
+	count, _ := strconv.Atoi(notification["count"])
+	counts, _ := parseGuess(notification["counts"])
+	round, _ := strconv.Atoi(notification["round"])
+	return roundResult{
+		gameID:     notification["gameID"],
+		winner:     notification["name"],
+		winners:    splitNames(notification["winners"]),
+		count:      count,
+		words:      strings.Fields(notification["words"]),
+		counts:     counts,
+		distances:  parseScores(notification["distances"]),
+		round:      round,
+		final:      notification["final"] == "true",
+		multiRound: notification["multiRound"] == "true",
+		standings:  parseScores(notification["scores"]),
 	}
-	return fmt.Sprintf("Welcome to Word Count %s! Resumed Game %s. Current state is %s.\n", username, gameID, gameState)
 }
 
-func msgGameCreated(gameID string) string {
-	return fmt.Sprintf("Game %s created! You are the leader of the game. Waiting for players to join.\n", gameID)
+func (result roundResult) fields(won bool) map[string]interface{} {
+	return map[string]interface{}{
+		"gameID":    result.gameID,
+		"winner":    result.winner,
+		"winners":   result.winners,
+		"won":       won,
+		"distances": distanceFields(result.distances),
+		"count":     result.count,
+		"words":     result.words,
+		"counts":    result.counts,
+		"round":     result.round,
+		"final":     result.final,
+		"scores":    scoreFields(result.standings),
+	}
 }
 
-func msgGameJoined(gameID string, state string) string {
-	return fmt.Sprintf("Joined Game %s. Current state is %s.\n", gameID, state)
+// standingsText is appended to the text messages of multi-round games
+func (result roundResult) standingsText() string {
+	if !result.multiRound {
+		return ""
+	}
+	return fmt.Sprintf("Standings after round %d: %s.\n", result.round, describeScores(result.standings))
 }
 
-func msgGameReady(gameID string) string {
-	return fmt.Sprintf("Game %s is ready to start.\n", gameID)
+// won tells whether a player is one of the winners
+func (result roundResult) won(name string) bool {
+	for _, winner := range result.winners {
+		if winner == name {
+			return true
+		}
+	}
+	return false
 }
 
-func msgGameStartedLeader(gameID string) string {
-	return fmt.Sprintf("Game %s is running. Please upload the file.\n", gameID)
+func msgIsWinner(result roundResult, name string) message {
+	others := make([]string, 0, len(result.winners))
+	for _, winner := range result.winners {
+		if winner != name {
+			others = append(others, winner)
+		}
+	}
+	if len(others) > 0 {
+		return newNotification("WINNER", result.fields(true),
+			fmt.Sprintf("Congratulations you share the win with %s!\n", strings.Join(others, ", "))+result.standingsText())
+	}
+	return newNotification("WINNER", result.fields(true),
+		"Congratulations you are the winner!\n"+result.standingsText())
 }
 
-func msgGameStartedNonLeader(gameID string, leader string) string {
-	return fmt.Sprintf("Game %s has started. Waiting for %s to upload the file.\n", gameID, leader)
+func msgIsLoser(result roundResult) message {
+	return newNotification("WINNER", result.fields(false),
+		"Sorry you lose! Better luck next time.\n"+result.standingsText())
 }
 
-func msgFileUploadedNonPicker() string {
-	return "Upload completed! Waiting for word selection.\n"
+// msgRoundOver tells spectators who won the round
+func msgRoundOver(result roundResult) message {
+	fields := result.fields(false)
+	fields["spectator"] = true
+	switch len(result.winners) {
+	case 0:
+		return newNotification("WINNER", fields, "Round over! Nobody guessed.\n"+result.standingsText())
+	case 1:
+		return newNotification("WINNER", fields,
+			fmt.Sprintf("Round over! The winner is %s.\n", result.winner)+result.standingsText())
+	default:
+		return newNotification("WINNER", fields,
+			fmt.Sprintf("Round over! The winners are %s.\n", strings.Join(result.winners, ", "))+result.standingsText())
+	}
 }
 
-func msgFileUploadedPicker(fileName string) string {
-	return fmt.Sprintf("Upload completed! Please select a word from %s.\n", fileName)
+// msgNoWord tells the players that the server found no word to pick
+func msgNoWord(gameID string, leader string) message {
+	return newNotification("NO_WORD", map[string]interface{}{"gameID": gameID, "leader": leader},
+		fmt.Sprintf("No word of the file can be picked under the rules of game %s. Waiting for %s to restart the game.\n", gameID, leader))
 }
 
-func msgBecomeNewLeader(gameID string) string {
-	return fmt.Sprintf("You are the new leader for game %s!\n", gameID)
+func msgExpired(gameID string, name string) message {
+	return newNotification("EXPIRED", map[string]interface{}{"gameID": gameID, "name": name},
+		fmt.Sprintf("%s was away too long and left game %s.\n", name, gameID))
 }
 
-func msgWordSetSuccess(word string) string {
-	return fmt.Sprintf("Word selected is %s! Guess the word count.\n", word)
+func msgPickTimeout(gameID string, late string, picker string) message {
+	fields := map[string]interface{}{"gameID": gameID, "phase": "pick", "name": late, "picker": picker}
+	if picker == "" {
+		return newNotification("TIMEOUT", fields,
+			fmt.Sprintf("Time is up for %s to pick a word in game %s. Waiting for a new picker.\n", late, gameID))
+	}
+	return newNotification("TIMEOUT", fields,
+		fmt.Sprintf("Time is up for %s to pick a word in game %s. %s picks instead.\n", late, gameID, picker))
 }
 
-func msgIsWinner() string {
-	return "Congratulations you are the winner!\n"
+func msgGuessTimeout(gameID string, missing []string) message {
+	return newNotification("TIMEOUT", map[string]interface{}{"gameID": gameID, "phase": "guess", "missing": missing},
+		fmt.Sprintf("Time is up for guesses in game %s.\n", gameID))
 }
 
-func msgIsLoser() string {
-	return "Sorry you lose! Better luck next time.\n"
+func msgRestartOrClose(result roundResult) message {
+	fields := map[string]interface{}{"gameID": result.gameID, "final": result.final, "scores": scoreFields(result.standings)}
+	if result.final {
+		return newNotification("GAME_COMPLETE", fields,
+			fmt.Sprintf("Game %s complete. All rounds have been played, please close the game.\n", result.gameID)+result.standingsText())
+	}
+	return newNotification("GAME_COMPLETE", fields,
+		fmt.Sprintf("Game %s complete. Do you want to restart or close the game?\n", result.gameID)+result.standingsText())
 }
 
-func msgRestartOrClose(gameID string) string {
-	return fmt.Sprintf("Game %s complete. Do you want to restart or close the game?\n", gameID)
+func msgScores(gameID string, round int, standings []standing) message {
+	fields := map[string]interface{}{"gameID": gameID, "round": round, "scores": scoreFields(standings)}
+	if round == 0 {
+		return newResponse("SCORES", fields, fmt.Sprintf("No rounds have been played in game %s yet.\n", gameID))
+	}
+	return newResponse("SCORES", fields,
+		fmt.Sprintf("Scores for game %s after round %d: %s.\n", gameID, round, describeScores(standings)))
 }
 
-func msgGameRestarted() string {
-	return "New game started!\n"
+func msgGameRestarted(gameID string) message {
+	return newNotification("RESTARTED", map[string]interface{}{"gameID": gameID}, "New game started!\n")
 }
 
-func msgBye() string {
-	return "Bye!\n"
+// msgUploadAccepted acknowledges a stored file, text clients wait for UPLOADED.
+func msgUploadAccepted(gameID string, fileName string) message {
+	return newResponse("UPLOAD_ACCEPTED", map[string]interface{}{"gameID": gameID, "filename": fileName}, "")
+}
+
+func msgUploadBegun(gameID, fileName, offset, size string) message {
+	fields := map[string]interface{}{"gameID": gameID, "filename": fileName, "offset": offset, "size": size}
+	if offset == "0" {
+		return newResponse("UPLOAD_BEGUN", fields,
+			fmt.Sprintf("Upload of %s started. Send %s bytes from offset 0.\n", fileName, size))
+	}
+	return newResponse("UPLOAD_BEGUN", fields,
+		fmt.Sprintf("Upload of %s resumed. Send the rest of the %s bytes from offset %s.\n", fileName, size, offset))
+}
+
+func msgChunkReceived(gameID, fileName, offset, size string) message {
+	return newResponse("CHUNK_RECEIVED", map[string]interface{}{"gameID": gameID, "filename": fileName, "offset": offset, "size": size},
+		fmt.Sprintf("Received %s of %s bytes of %s.\n", offset, size, fileName))
+}
+
+// msgUploadPending reminds a reconnected leader of its unfinished upload
+func msgUploadPending(gameID, fileName, offset, size string) message {
+	return newNotification("UPLOAD_PENDING", map[string]interface{}{"gameID": gameID, "filename": fileName, "offset": offset, "size": size},
+		fmt.Sprintf("Upload of %s stopped at %s of %s bytes. Continue from offset %s.\n", fileName, offset, size, offset))
+}
+
+func msgCorpora(corpora []corpusEntry) message {
+	if len(corpora) == 0 {
+		return newResponse("CORPORA", map[string]interface{}{"corpora": corpora}, "The corpus library is empty.\n")
+	}
+	desc := make([]string, 0, len(corpora))
+	for _, corpus := range corpora {
+		desc = append(desc, fmt.Sprintf("%s (%d bytes)", corpus.Name, corpus.Size))
+	}
+	return newResponse("CORPORA", map[string]interface{}{"corpora": corpora},
+		fmt.Sprintf("Corpora in the library: %s.\n", strings.Join(desc, ", ")))
+}
+
+func msgGameClosed(gameID string) message {
+	return newNotification("CLOSED", map[string]interface{}{"gameID": gameID}, "Bye!\n")
+}
+
+func msgChat(gameID string, from string, text string) message {
+	return newNotification("CHAT", map[string]interface{}{"gameID": gameID, "from": from, "text": text},
+		fmt.Sprintf("[%s] %s: %s\n", gameID, from, text))
+}
+
+func msgWhisper(from string, text string) message {
+	return newNotification("WHISPER", map[string]interface{}{"from": from, "text": text},
+		fmt.Sprintf("%s whispers: %s\n", from, text))
+}
+
+// msgChatSent acknowledges a SAY, text clients see nothing.
+func msgChatSent(gameID string) message {
+	return newResponse("CHAT_SENT", map[string]interface{}{"gameID": gameID}, "")
+}
+
+// msgWhisperSent acknowledges a WHISPER, text clients see nothing.
+func msgWhisperSent(to string) message {
+	return newResponse("WHISPER_SENT", map[string]interface{}{"to": to}, "")
+}
+
+func msgMuted(name string, muted bool) message {
+	if muted {
+		return newResponse("MUTED", map[string]interface{}{"name": name}, fmt.Sprintf("%s is muted.\n", name))
+	}
+	return newResponse("UNMUTED", map[string]interface{}{"name": name}, fmt.Sprintf("%s is no longer muted.\n", name))
+}
+
+func msgBye() message {
+	return newResponse("BYE", nil, "Bye!\n")
 }
 
 // errors
 
-func msgInvalidArgs(cmd string) string {
-	return fmt.Sprintf("Invalid arguments for command %s.\n", cmd)
+func msgInvalidArgs(cmd string) message {
+	return newError("INVALID_ARGS", map[string]interface{}{"cmd": cmd},
+		fmt.Sprintf("Invalid arguments for command %s.\n", cmd))
+}
+
+func msgInvalidJSON() message {
+	return newError("INVALID_JSON", nil, "Error! Please send a valid JSON command.\n")
+}
+
+// msgLineTooLong answers a command line longer than its limit, which is
+// skipped.
+func msgLineTooLong(limit int) message {
+	return newError("LINE_TOO_LONG", map[string]interface{}{"limit": limit},
+		fmt.Sprintf("The command is too long, the limit is %d bytes.\n", limit))
+}
+
+func msgNoHello() message {
+	return newError("NO_HELLO", nil, "New player must always start with HELLO!\n")
+}
+
+func msgAuthFail(username string, reason string) message {
+	fields := map[string]interface{}{"name": username, "reason": reason}
+	switch reason {
+	case "authentication required":
+		return newError("AUTH_FAILED", fields,
+			fmt.Sprintf("%s is a registered name. Send HELLO %s password=<password> or token=<token>.\n", username, username))
+	case "name in use":
+		return newError("AUTH_FAILED", fields,
+			fmt.Sprintf("%s is playing right now and cannot be registered. Try another name.\n", username))
+	case "invalid token":
+		return newError("AUTH_FAILED", fields, "Invalid or expired token. Send HELLO with your password instead.\n")
+	case "invalid session":
+		return newError("AUTH_FAILED", fields, "Invalid or expired session. Send HELLO to start over.\n")
+	default:
+		return newError("AUTH_FAILED", fields, "Wrong password. Try again.\n")
+	}
+}
+
+// msgResumeToken hands out the token of a password login, it comes before
+// the welcome
+func msgResumeToken(username string, token string) message {
+	return newResponse("TOKEN", map[string]interface{}{"name": username, "token": token},
+		fmt.Sprintf("Your resume token is %s. Send HELLO %s token=%s to come back without your password.\n", token, username, token))
+}
+
+func msgSession(session string) message {
+	return newResponse("SESSION", map[string]interface{}{"session": session},
+		fmt.Sprintf("Your session token is %s. Send RESUME %s to reconnect.\n", session, session))
+}
+
+func msgTakenOver(username string) message {
+	return newNotification("TAKEN_OVER", map[string]interface{}{"name": username},
+		fmt.Sprintf("%s logged in on another connection. Bye!\n", username))
+}
+
+// msgGames lists the games of a LIST_GAMES, one line per game
+func msgGames(entries []lobbyEntry) message {
+	list := make([]interface{}, 0, len(entries))
+	lines := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		list = append(list, entry.fields())
+		lines = append(lines, fmt.Sprintf("Game %s: %s.", entry.gameID, entry))
+	}
+	fields := map[string]interface{}{"games": list}
+	if len(entries) == 0 {
+		return newResponse("GAMES", fields, "No games found. Create one with NEW_GAME <gameTag>.\n")
+	}
+	return newResponse("GAMES", fields, fmt.Sprintf("Games:\n%s\n", strings.Join(lines, "\n")))
+}
+
+func msgLobbyWatch(watching bool) message {
+	if watching {
+		return newResponse("WATCHING_LOBBY", nil, "Watching the lobby. You will be told when games open, fill up, start or close.\n")
+	}
+	return newResponse("UNWATCHED_LOBBY", nil, "Stopped watching the lobby.\n")
+}
+
+func msgLobbyNews(msg string, entry lobbyEntry) message {
+	switch msg {
+	case "GAME_FULL":
+		return newNotification(msg, entry.fields(), fmt.Sprintf("Game %s is full.\n", entry.gameID))
+	case "GAME_STARTED":
+		return newNotification(msg, entry.fields(), fmt.Sprintf("Game %s has started.\n", entry.gameID))
+	case "GAME_CLOSED":
+		return newNotification(msg, entry.fields(), fmt.Sprintf("Game %s was closed.\n", entry.gameID))
+	}
+	return newNotification(msg, entry.fields(),
+		fmt.Sprintf("Game %s is open: %s. Send JOIN_GAME %s to join.\n", entry.gameID, entry, entry.gameID))
+}
+
+// msgMyGames lists the games of a player, one line per game
+func msgMyGames(games []map[string]string) message {
+	if len(games) == 0 {
+		return newResponse("MY_GAMES", map[string]interface{}{"games": []interface{}{}},
+			"You are not in any game. Create a new game or join an existing game.\n")
+	}
+	list := make([]interface{}, 0, len(games))
+	lines := make([]string, 0, len(games))
+	for _, game := range games {
+		round, _ := strconv.Atoi(game["round"])
+		roles := strings.Split(game["roles"], ",")
+		list = append(list, map[string]interface{}{"gameID": game["gameID"], "state": game["state"], "roles": roles, "round": round})
+		lines = append(lines, fmt.Sprintf("Game %s: %s, round %d, you are the %s.", game["gameID"], game["state"], round, strings.Join(roles, " and ")))
+	}
+	return newResponse("MY_GAMES", map[string]interface{}{"games": list},
+		fmt.Sprintf("Your games:\n%s\n", strings.Join(lines, "\n")))
+}
+
+func msgInvalidUsrname() message {
+	return newError("INVALID_USERNAME", nil, "Invalid user name. Try again.\n")
 }
 
-func msgNoHello() string {
-	return "New player must always start with HELLO!\n"
+func msgInvalidRules(reason string) message {
+	return newError("INVALID_RULES", map[string]interface{}{"reason": reason},
+		fmt.Sprintf("Invalid game rules: %s.\n", reason))
 }
 
-func msgInvalidUsrname() string {
-	return "Invalid user name. Try again.\n"
+func msgGameExists(gameID string) message {
+	return newError("GAME_EXISTS", map[string]interface{}{"gameID": gameID},
+		fmt.Sprintf("Game %s already exists, please provide a new game tag.\n", gameID))
 }
 
-func msgGameExists(gameID string) string {
-	return fmt.Sprintf("Game %s already exists, please provide a new game tag.\n", gameID)
+func msgGameNotFound(gameID string) message {
+	return newError("GAME_NOT_FOUND", map[string]interface{}{"gameID": gameID},
+		fmt.Sprintf("Game %s doesn't exist! Please enter correct tag or create a new game.\n", gameID))
 }
 
-func msgGameNotFound(gameID string) string {
-	return fmt.Sprintf("Game %s doesn't exist! Please enter correct tag or create a new game.\n", gameID)
+func msgPlayerNotFound(name string) message {
+	return newError("PLAYER_NOT_FOUND", map[string]interface{}{"name": name},
+		fmt.Sprintf("Player %s doesn't exist!\n", name))
 }
 
-func msgJoinGameFail(gameID string) string {
-	return fmt.Sprintf("Game %s is full or already in progress. Connect back later.\n", gameID)
+func msgJoinGameFail(gameID string) message {
+	return newError("JOIN_FAILED", map[string]interface{}{"gameID": gameID},
+		fmt.Sprintf("Game %s is full or already in progress. Connect back later.\n", gameID))
 }
 
-func msgStartGameFail(gameID, reason, wait, leader string) string {
+func msgStartGameFail(gameID, reason, wait, leader string) message {
+	fields := map[string]interface{}{"gameID": gameID, "reason": reason}
 	switch reason {
 	case "already started":
-		return fmt.Sprintf("Game %s has already started! Please create a new game.\n", gameID)
+		return newError("START_FAILED", fields,
+			fmt.Sprintf("Game %s has already started! Please create a new game.\n", gameID))
 	case "not a leader":
-		return fmt.Sprintf("Only the leader can start the game. Please contact %s.\n", leader)
+		fields["leader"] = leader
+		return newError("START_FAILED", fields,
+			fmt.Sprintf("Only the leader can start the game. Please contact %s.\n", leader))
 	case "not enough players":
-		return fmt.Sprintf("Can't start the game %s, waiting for %s more players.\n", gameID, wait)
+		fields["wait"] = wait
+		return newError("START_FAILED", fields,
+			fmt.Sprintf("Can't start the game %s, waiting for %s more players.\n", gameID, wait))
 	default:
-		return "An unknown error occurred while attempting to start the game.\n"
+		return newError("START_FAILED", fields, "An unknown error occurred while attempting to start the game.\n")
 	}
 }
 
-func msgNonLeaderUpload(leader string) string {
-	return fmt.Sprintf("Only the leader can upload the file. Please contact %s.\n", leader)
+func msgWatchGameFail(gameID string, reason string) message {
+	fields := map[string]interface{}{"gameID": gameID, "reason": reason}
+	switch reason {
+	case "already joined":
+		return newError("WATCH_FAILED", fields,
+			fmt.Sprintf("You already play in game %s.\n", gameID))
+	case "already watching":
+		return newError("WATCH_FAILED", fields,
+			fmt.Sprintf("You are already watching game %s.\n", gameID))
+	default:
+		return newError("WATCH_FAILED", fields, "An unknown error occurred while attempting to watch the game.\n")
+	}
+}
+
+func msgChatFail(reason, gameID, to string) message {
+	fields := map[string]interface{}{"reason": reason}
+	if gameID != "" {
+		fields["gameID"] = gameID
+	}
+	if to != "" {
+		fields["to"] = to
+	}
+	switch reason {
+	case "too long":
+		fields["limit"] = MAX_CHAT_LENGTH
+		return newError("CHAT_FAILED", fields,
+			fmt.Sprintf("Message is too long, the limit is %d characters.\n", MAX_CHAT_LENGTH))
+	case "line break":
+		return newError("CHAT_FAILED", fields, "Messages cannot span several lines.\n")
+	case "did not join the game":
+		return newError("CHAT_FAILED", fields, fmt.Sprintf("You do not play in game %s.\n", gameID))
+	case "inbox full":
+		return newError("CHAT_FAILED", fields,
+			fmt.Sprintf("%s has too many unread messages. Try again later.\n", to))
+	default:
+		return newError("CHAT_FAILED", fields, "An unknown error occurred while attempting to send the message.\n")
+	}
+}
+
+func msgNonLeaderUpload(leader string) message {
+	return newError("UPLOAD_FAILED", map[string]interface{}{"reason": "not a leader", "leader": leader},
+		fmt.Sprintf("Only the leader can upload the file. Please contact %s.\n", leader))
+}
+
+func msgUploadFail(gameID, reason, size string, received int) message {
+	fields := map[string]interface{}{"gameID": gameID, "reason": reason}
+	switch reason {
+	case "invalid size":
+		return newError("UPLOAD_FAILED", fields, fmt.Sprintf("Invalid file size %s.\n", size))
+	case "too large":
+		fields["limit"] = MAX_UPLOAD_SIZE
+		return newError("UPLOAD_FAILED", fields,
+			fmt.Sprintf("The file is too large, the limit is %d bytes.\n", MAX_UPLOAD_SIZE))
+	case "short":
+		fields["size"], fields["received"] = size, received
+		return newError("UPLOAD_FAILED", fields,
+			fmt.Sprintf("Upload incomplete! Received %d of %s bytes.\n", received, size))
+	case "oversized":
+		fields["size"] = size
+		return newError("UPLOAD_FAILED", fields,
+			fmt.Sprintf("The file is longer than the declared %s bytes.\n", size))
+	case "corpus too large":
+		fields["limit"] = MAX_CORPUS_SIZE
+		return newError("UPLOAD_FAILED", fields,
+			fmt.Sprintf("The file is too large, the limit is %d bytes.\n", MAX_CORPUS_SIZE))
+	case "invalid file name":
+		return newError("UPLOAD_FAILED", fields, "Invalid file name, it may not start with a dot or contain slashes.\n")
+	case "checksum mismatch":
+		return newError("UPLOAD_FAILED", fields, "The file does not match its checksum. Please upload it again.\n")
+	case "invalid corpus name":
+		return newError("UPLOAD_FAILED", fields, "Invalid corpus name, it may not start with a dot or contain slashes.\n")
+	case "unknown format":
+		return newError("UPLOAD_FAILED", fields, "Unknown format, use text, html, markdown, csv or json.\n")
+	case "corrupt archive":
+		return newError("UPLOAD_FAILED", fields, "The archive is damaged and cannot be extracted.\n")
+	case "unsafe path":
+		return newError("UPLOAD_FAILED", fields, "The archive has a file outside its own directory.\n")
+	case "too many files":
+		fields["limit"] = MAX_ARCHIVE_FILES
+		return newError("UPLOAD_FAILED", fields,
+			fmt.Sprintf("The archive has too many files, the limit is %d.\n", MAX_ARCHIVE_FILES))
+	case "too large when extracted":
+		return newError("UPLOAD_FAILED", fields, "The archive is too large when extracted.\n")
+	case "no text files":
+		return newError("UPLOAD_FAILED", fields, "The archive has no text files.\n")
+	default:
+		return newError("UPLOAD_FAILED", fields, "Invalid arguments for command FILE_UPLOAD.\n")
+	}
+}
+
+// msgUploadSessionFail explains why the game refused an UPLOAD_BEGIN,
+// UPLOAD_CHUNK or UPLOAD_COMMIT
+func msgUploadSessionFail(gameID string, response map[string]string) message {
+	reason := response["reason"]
+	fields := map[string]interface{}{"gameID": gameID, "reason": reason}
+	switch reason {
+	case "not a leader":
+		fields["leader"] = response["leader"]
+		return newError("UPLOAD_FAILED", fields,
+			fmt.Sprintf("Only the leader can upload the file. Please contact %s.\n", response["leader"]))
+	case "file exists":
+		return msgFileExists(gameID, response["filename"])
+	case "no upload":
+		return newError("UPLOAD_FAILED", fields,
+			fmt.Sprintf("No upload in progress for game %s. Send UPLOAD_BEGIN first.\n", gameID))
+	case "not now":
+		return newError("UPLOAD_FAILED", fields,
+			fmt.Sprintf("Game %s takes the file once it is running and until the word is picked.\n", gameID))
+	case "bad offset":
+		fields["offset"] = response["offset"]
+		return newError("UPLOAD_FAILED", fields,
+			fmt.Sprintf("Wrong offset! Send the data from offset %s.\n", response["offset"]))
+	case "too long":
+		fields["offset"], fields["size"] = response["offset"], response["size"]
+		return newError("UPLOAD_FAILED", fields,
+			fmt.Sprintf("The chunk goes past the end of the %s byte file.\n", response["size"]))
+	case "incomplete":
+		fields["offset"], fields["size"] = response["offset"], response["size"]
+		return newError("UPLOAD_FAILED", fields,
+			fmt.Sprintf("Upload incomplete! Received %s of %s bytes.\n", response["offset"], response["size"]))
+	case "checksum mismatch":
+		return newError("UPLOAD_FAILED", fields, "The file does not match its checksum. Please upload it again.\n")
+	case "corrupt archive", "unsafe path", "too many files", "too large when extracted", "no text files":
+		return msgUploadFail(gameID, reason, "", 0)
+	case "no corpus":
+		fields["name"] = response["name"]
+		return newError("UPLOAD_FAILED", fields,
+			fmt.Sprintf("No corpus named %s in the library. Send LIST_CORPORA to see them.\n", response["name"]))
+	case "corpus exists":
+		fields["name"] = response["name"]
+		return newError("UPLOAD_FAILED", fields,
+			fmt.Sprintf("The library already has a different corpus named %s.\n", response["name"]))
+	case "unknown column":
+		fields["filename"], fields["column"] = response["filename"], response["column"]
+		return newError("UPLOAD_FAILED", fields,
+			fmt.Sprintf("The CSV file %s has no column %s.\n", response["filename"], response["column"]))
+	default:
+		return newError("UPLOAD_FAILED", fields, "An unknown error occurred while attempting to store the file.\n")
+	}
 }
 
-func msgFileExists(gameID string, fileName string) string {
-	return fmt.Sprintf("Upload failed! File %s already exists for game %s.\n", fileName, gameID)
+func msgFileExists(gameID string, fileName string) message {
+	return newError("UPLOAD_FAILED", map[string]interface{}{"reason": "file exists", "gameID": gameID, "filename": fileName},
+		fmt.Sprintf("Upload failed! File %s already exists for game %s.\n", fileName, gameID))
 }
 
-func msgWordSetFail(reason, word string, pickerName string, leader string) string {
+// msgWordSetFail tells the picker why its words were refused, the word of
+// the response is the one at fault
+func msgWordSetFail(response map[string]string) message {
+	reason, word, pickerName, leader := response["reason"], response["word"], response["picker"], response["leader"]
+	fields := map[string]interface{}{"reason": reason, "word": word}
 	switch reason {
+	case "wrong number of words":
+		fields["words"] = response["words"]
+		return newError("WORD_SET_FAILED", fields,
+			fmt.Sprintf("Pick %s different words in this game, separated by spaces.\n", response["words"]))
 	case "not a picker":
-		return fmt.Sprintf("Only the picker can pick the word. Please contact %s.\n", pickerName)
+		fields["picker"] = pickerName
+		return newError("WORD_SET_FAILED", fields,
+			fmt.Sprintf("Only the picker can pick the word. Please contact %s.\n", pickerName))
 	case "not a valid choice":
-		return fmt.Sprintf("Word %s is not a valid choice, choose another word.\n", word)
+		return newError("WORD_SET_FAILED", fields,
+			fmt.Sprintf("Word %s is not a valid choice, choose another word.\n", word))
+	case "indexing":
+		return newError("WORD_SET_FAILED", fields, "The words of the file are still being counted. Please pick again in a moment.\n")
+	case "server picks":
+		return newError("WORD_SET_FAILED", fields, "The server picks the word in this game.\n")
+	case "too short":
+		return newError("WORD_SET_FAILED", fields,
+			fmt.Sprintf("Word %s is too short for the rules of the game, choose a longer word.\n", word))
+	case "too rare":
+		return newError("WORD_SET_FAILED", fields,
+			fmt.Sprintf("Word %s is too rare for the rules of the game, choose a more common word.\n", word))
+	case "too common":
+		return newError("WORD_SET_FAILED", fields,
+			fmt.Sprintf("Word %s is too common for the rules of the game, choose a rarer word.\n", word))
+	case "stop word":
+		return newError("WORD_SET_FAILED", fields,
+			fmt.Sprintf("Word %s may not be picked in this game, choose another word.\n", word))
 	case "file not ready":
-		return fmt.Sprintf("No file uploaded. Please contact %s.\n", leader)
+		fields["leader"] = leader
+		return newError("WORD_SET_FAILED", fields,
+			fmt.Sprintf("No file uploaded. Please contact %s.\n", leader))
 	default:
-		return "An unknown error occurred while attempting to set the word.\n"
+		return newError("WORD_SET_FAILED", fields, "An unknown error occurred while attempting to set the word.\n")
 	}
 }
 
-func msgInvalidCmd() string {
-	return "Error! Please send a valid command.\n"
+// msgHints lists the candidate words of each frequency band, bands with no
+// candidates are left out of the text
+func msgHints(gameID string, response map[string]string) message {
+	fields := map[string]interface{}{"gameID": gameID}
+	desc := make([]string, 0, len(hintBands))
+	for _, band := range hintBands {
+		words := strings.Fields(response[band])
+		fields[band] = words
+		if len(words) > 0 {
+			desc = append(desc, fmt.Sprintf("%s: %s", band, strings.Join(words, ", ")))
+		}
+	}
+	if len(desc) == 0 {
+		return newResponse("HINTS", fields, "No word of the file can be picked under the rules of the game.\n")
+	}
+	return newResponse("HINTS", fields, fmt.Sprintf("Words you may pick, %s.\n", strings.Join(desc, "; ")))
 }
 
-func msgWordCountFail(reason, gameID string) string {
+func msgHintsFail(gameID string, response map[string]string) message {
+	reason := response["reason"]
+	fields := map[string]interface{}{"gameID": gameID, "reason": reason}
 	switch reason {
+	case "not a picker":
+		fields["picker"] = response["picker"]
+		return newError("HINTS_FAILED", fields,
+			fmt.Sprintf("Only the picker gets hints. Please contact %s.\n", response["picker"]))
+	case "file not ready":
+		fields["leader"] = response["leader"]
+		return newError("HINTS_FAILED", fields, fmt.Sprintf("No file uploaded. Please contact %s.\n", response["leader"]))
+	case "server picks":
+		return newError("HINTS_FAILED", fields, "The server picks the word in this game.\n")
+	case "indexing":
+		return newError("HINTS_FAILED", fields, "The words of the file are still being counted. Please ask again in a moment.\n")
+	default:
+		return newError("HINTS_FAILED", fields, "The word has already been selected.\n")
+	}
+}
+
+func msgInvalidCmd() message {
+	return newError("INVALID_COMMAND", nil, "Error! Please send a valid command.\n")
+}
+
+func msgWordCountFail(reason, gameID string, words string) message {
+	fields := map[string]interface{}{"reason": reason, "gameID": gameID}
+	switch reason {
+	case "wrong number of guesses":
+		fields["words"] = words
+		return newError("WORD_COUNT_FAILED", fields,
+			fmt.Sprintf("Guess the count of each of the %s words of game %s, in the order they were picked.\n", words, gameID))
 	case "did not join the game":
-		return "Error! Please send a valid command.\n"
+		return newError("WORD_COUNT_FAILED", fields, "Error! Please send a valid command.\n")
 	case "not ready for guesses":
-		return fmt.Sprintf("No word has been selected yet for game %s. Wait!\n", gameID)
+		return newError("WORD_COUNT_FAILED", fields,
+			fmt.Sprintf("No word has been selected yet for game %s. Wait!\n", gameID))
+	case "leader may not guess":
+		return newError("WORD_COUNT_FAILED", fields,
+			fmt.Sprintf("The leader does not guess in game %s.\n", gameID))
 	default:
-		return "An unknown error occurred while attempting to set the word.\n"
+		return newError("WORD_COUNT_FAILED", fields, "An unknown error occurred while attempting to set the word.\n")
 	}
 }
 
-func msgGameRestartFail(leader string) string {
-	return fmt.Sprintf("Only the leader can restart the game. Please contact %s.\n", leader)
+func msgGameRestartFail(gameID, reason, leader, rounds string) message {
+	fields := map[string]interface{}{"gameID": gameID, "reason": reason}
+	switch reason {
+	case "no rounds left":
+		fields["rounds"] = rounds
+		return newError("RESTART_FAILED", fields,
+			fmt.Sprintf("Game %s has no rounds left. Please close the game.\n", gameID))
+	default:
+		fields["leader"] = leader
+		return newError("RESTART_FAILED", fields,
+			fmt.Sprintf("Only the leader can restart the game. Please contact %s.\n", leader))
+	}
 }
 
-func msgGameCloseFail(leader string) string {
-	return fmt.Sprintf("Only the leader can close the game. Please contact %s.\n", leader)
+func msgGameCloseFail(leader string) message {
+	return newError("CLOSE_FAILED", map[string]interface{}{"leader": leader},
+		fmt.Sprintf("Only the leader can close the game. Please contact %s.\n", leader))
 }
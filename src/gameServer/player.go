@@ -2,153 +2,530 @@ package main
 
 import (
 	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"io"
 	"net"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
 )
 
-func readFile(chanInput chan string, cmdLine string) string {
+// clientInput is one command read from a connection. A text FILE_UPLOAD
+// carries its payload, read as raw bytes by readUpload.
+type clientInput struct {
+	line      string
+	payload   string
+	uploadErr string // why the payload was not read in full, "" if it was
+	tooLong   int    // the limit of a line that was too long and was skipped, 0 if it was not
+}
+
+// errLineTooLong is returned when a command line exceeds its limit
+var errLineTooLong = errors.New("line too long")
+
+// readInput reads the commands of a connection, one per line, until the
+// connection closes.
+func readInput(conn net.Conn, chanInput chan clientInput) {
+	defer close(chanInput)
+	reader := bufio.NewReader(conn)
+	for {
+		limit := MAX_LINE_LENGTH
+		if next, err := reader.Peek(1); err == nil && next[0] == '{' {
+			// a JSON FILE_UPLOAD carries its data, escaped, in the line
+			limit = 2 * MAX_UPLOAD_SIZE
+		}
+		first, delim, err := readToken(reader, limit)
+		if err == nil && (first == "FILE_UPLOAD" || first == "UPLOAD_CHUNK") && delim == ' ' {
+			input, alive := readUpload(conn, reader, chanInput, first)
+			if input.line != "" || input.tooLong != 0 {
+				chanInput <- input
+			}
+			if !alive {
+				return
+			}
+			continue
+		}
+		line := first
+		if err == nil && delim == ' ' {
+			var rest string
+			rest, err = readRest(reader, limit-len(first)-1)
+			line += " " + strings.TrimSuffix(rest, "\n")
+		}
+		if err == errLineTooLong {
+			chanInput <- clientInput{tooLong: limit}
+			if skipLine(reader) != nil {
+				return
+			}
+			continue
+		}
+		line = strings.TrimSuffix(line, "\r")
+		if err != nil {
+			// like bufio.Scanner, a last line without a newline still counts
+			if line != "" {
+				chanInput <- clientInput{line: line}
+			}
+			return
+		}
+		chanInput <- clientInput{line: line}
+	}
+}
+
+// readToken reads up to the next space or newline, returning the delimiter,
+// or errLineTooLong after limit bytes
+func readToken(reader *bufio.Reader, limit int) (string, byte, error) {
+	var builder strings.Builder
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return builder.String(), 0, err
+		}
+		if b == ' ' || b == '\n' {
+			return strings.TrimSuffix(builder.String(), "\r"), b, nil
+		}
+		if builder.Len() >= limit {
+			reader.UnreadByte()
+			return "", 0, errLineTooLong
+		}
+		builder.WriteByte(b)
+	}
+}
+
+// readRest reads the rest of a line with its newline, or returns
+// errLineTooLong after limit bytes
+func readRest(reader *bufio.Reader, limit int) (string, error) {
 	var builder strings.Builder
-	cmd := strings.Split(cmdLine, " ")
-	fileSize, _ := strconv.Atoi(cmd[3])
-	start := strings.Index(cmdLine, cmd[3]) + len(cmd[3]) + 1
-	builder.WriteString(cmdLine[start:])
-	builder.WriteString("\n")
-	fileSize -= len(cmdLine) - start + 1
-	for fileSize > 0 {
-		line := <-chanInput
-		builder.WriteString(line)
-		builder.WriteString("\n")
-		fileSize -= len(line) + 1
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if builder.Len()+len(chunk) > limit+1 {
+			if chunk[len(chunk)-1] == '\n' {
+				reader.UnreadByte()
+			}
+			return "", errLineTooLong
+		}
+		builder.Write(chunk)
+		if err != bufio.ErrBufferFull {
+			return builder.String(), err
+		}
 	}
-	<-chanInput
-	return builder.String()
+}
+
+// skipLine discards the rest of a line without keeping it
+func skipLine(reader *bufio.Reader) error {
+	for {
+		_, err := reader.ReadSlice('\n')
+		if err != bufio.ErrBufferFull {
+			return err
+		}
+	}
+}
+
+// readUpload reads the rest of a text FILE_UPLOAD or UPLOAD_CHUNK,
+//
+//	FILE_UPLOAD <gameID> <filename> [sha256=<hex>] <size> <data>\n
+//	UPLOAD_CHUNK <gameID> <offset> [sha256=<hex>] <size> <data>\n
+//
+// where data is exactly size raw bytes, starting after the space (or the
+// newline) that follows size. The line is returned with size as the fourth
+// argument and the options after it, like jsonCodec does. An empty line
+// means the upload has already been answered. alive is false when the
+// connection closed.
+func readUpload(conn net.Conn, reader *bufio.Reader, chanInput chan clientInput, cmd string) (input clientInput, alive bool) {
+	header := []string{cmd}
+	options := make([]string, 0)
+	size := ""
+	for size == "" {
+		token, delim, err := readToken(reader, MAX_LINE_LENGTH)
+		if err == errLineTooLong {
+			return clientInput{tooLong: MAX_LINE_LENGTH}, skipLine(reader) == nil
+		}
+		if err != nil {
+			return clientInput{line: strings.Join(append(header, token), " ")}, false
+		}
+		if len(header) < 3 {
+			header = append(header, token)
+		} else if strings.Contains(token, "=") {
+			options = append(options, token)
+		} else {
+			size = token
+		}
+		if delim == '\n' && size == "" {
+			// no size, let FILE_UPLOAD complain about the arguments
+			return clientInput{line: strings.Join(append(header, options...), " ")}, true
+		}
+	}
+	input.line = strings.Join(append(append(header, size), options...), " ")
+
+	n, err := strconv.Atoi(size)
+	if err != nil || n < 0 {
+		// not a size, so there is no telling where the data ends
+		return input, skipLine(reader) == nil
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Duration(UPLOAD_TIMEOUT) * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	if n > MAX_UPLOAD_SIZE {
+		// refuse at once, then skip the data to find the next command
+		input.uploadErr = "too large"
+		chanInput <- input
+		_, err = io.CopyN(io.Discard, reader, int64(n))
+		if err == nil {
+			err = skipLine(reader)
+		}
+		return clientInput{}, err == nil || errors.Is(err, os.ErrDeadlineExceeded)
+	}
+
+	data := make([]byte, n)
+	read, err := io.ReadFull(reader, data)
+	input.payload = string(data[:read])
+	if err != nil {
+		input.uploadErr = "short"
+		return input, errors.Is(err, os.ErrDeadlineExceeded)
+	}
+	// the data is followed by the end of the line
+	rest, err := readRest(reader, MAX_LINE_LENGTH)
+	if err == errLineTooLong || strings.TrimRight(rest, "\r\n") != "" {
+		input.uploadErr = "oversized"
+	}
+	if err == errLineTooLong {
+		err = skipLine(reader)
+	}
+	return input, err == nil || errors.Is(err, os.ErrDeadlineExceeded)
 }
 
 type Player struct {
-	name    string
-	gameIDs map[string]chan map[string]string // joined games and their mailboxes
-	mailbox chan map[string]string
-	server  *GameServer
+	name     string
+	gameIDs  map[string]chan map[string]string // joined games and their mailboxes
+	watching map[string]chan map[string]string // games watched as a spectator and their mailboxes
+	muted    map[string]bool                   // players whose chat is not shown to this player
+	mailbox  chan map[string]string
+	chat     chan map[string]string // whispers, buffered so they wait for a disconnected player
+	lobby    chan map[string]string // lobby news while watching the lobby, see lobby.go
+	server   *GameServer
+}
+
+// playerConn is the connection a player is online on. A HELLO for a player
+// that is online takes over: the new connection asks the old one to detach
+// and waits until it is gone, so only one connection at a time reads the
+// mailbox of a player.
+type playerConn struct {
+	name   string
+	conn   net.Conn
+	detach chan bool // buffered, asks the connection to give up the player
+	gone   chan bool // closed once the connection is done with the player
+}
+
+// checkUpload validates the payload of a FILE_UPLOAD against its size
+// and options, returning the reason it is rejected or "" if it is fine.
+func checkUpload(cmd []string, data string) string {
+	size, err := strconv.Atoi(cmd[3])
+	if err != nil || size < 0 {
+		return "invalid size"
+	}
+	if size > MAX_UPLOAD_SIZE {
+		return "too large"
+	}
+	if len(data) < size {
+		return "short"
+	}
+	if len(data) > size {
+		return "oversized"
+	}
+	for _, option := range cmd[4:] {
+		key, value, _ := strings.Cut(option, "=")
+		switch key {
+		case "sha256":
+			sum := sha256.Sum256([]byte(data))
+			if !strings.EqualFold(hex.EncodeToString(sum[:]), value) {
+				return "checksum mismatch"
+			}
+		case "format":
+			if !validFormat(value) {
+				return "unknown format"
+			}
+		case "columns":
+		case "save":
+			if !validFileName(value) {
+				return "invalid corpus name"
+			}
+		default:
+			return "unknown option"
+		}
+	}
+	return ""
+}
+
+// uploadOptions copies the key=value options of an upload command to the
+// request for the game, returning the reason if one is not allowed
+func uploadOptions(options []string, request map[string]string, allowed ...string) string {
+	for _, option := range options {
+		key, value, _ := strings.Cut(option, "=")
+		known := false
+		for _, k := range allowed {
+			known = known || k == key
+		}
+		switch {
+		case !known:
+			return "unknown option"
+		case key == "format" && !validFormat(value):
+			return "unknown format"
+		case key == "save" && !validFileName(value):
+			return "invalid corpus name"
+		}
+		request[key] = value
+	}
+	return ""
+}
+
+// chatText joins the words of a SAY or WHISPER, returning "" if the text
+// is empty and an error reason if it cannot be sent.
+func chatText(words []string) (string, string) {
+	text := strings.TrimSpace(strings.Join(words, " "))
+	if len(text) > MAX_CHAT_LENGTH {
+		return "", "too long"
+	}
+	if strings.ContainsAny(text, "\r\n") {
+		return "", "line break"
+	}
+	return text, ""
+}
+
+// validName tells whether a player name may be used. The games pass lists
+// of names around joined with "," and ":", like the winners of a round.
+func validName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, ",:") && strings.IndexFunc(name, unicode.IsSpace) < 0
 }
 
 // client routine
 func clientRoutine(conn net.Conn, server *GameServer) error {
-	scanner := bufio.NewScanner(conn)
 	var player *Player
 	leaders := make(map[string]string)
-	chanInput := make(chan string)
-	go func() {
-		for scanner.Scan() {
-			chanInput <- scanner.Text()
+	chanInput := make(chan clientInput)
+	go readInput(conn, chanInput)
+	pc := playerConn{conn: conn, detach: make(chan bool, 1), gone: make(chan bool)}
+	defer close(pc.gone)
+
+	// the HELLO line selects the wire format of this session
+	var client codec = textCodec{}
+	send := func(m message) {
+		if _, text := client.(textCodec); text && player != nil && len(player.gameIDs)+len(player.watching) > 1 {
+			// in several games, tell which one a message is about
+			m = m.tagged()
+		}
+		io.WriteString(conn, client.encode(m))
+	}
+
+	// notifications that come while the routine waits for the response of a
+	// game, the main loop handles them before it reads the mailbox again
+	early := make([]map[string]string, 0)
+	await := func() map[string]string {
+		for {
+			mail := <-player.mailbox
+			if mail["msg"] == "" {
+				return mail
+			}
+			early = append(early, mail)
 		}
-		close(chanInput)
-	}()
+	}
+	replay := make(chan map[string]string, 1)
+	// tell sends a request to a game. The game may be busy telling this
+	// player something, like the chat of another player, and would never
+	// take the request, so the mail waits in early too.
+	tell := func(game chan map[string]string, request map[string]string) {
+		for {
+			select {
+			case game <- request:
+				return
+			case mail := <-player.mailbox:
+				early = append(early, mail)
+			}
+		}
+	}
 
 	// hello
-	hello := false
-	for cmdLine := range chanInput {
-		cmd := strings.Split(cmdLine, " ")
-		if cmd[0] == "FILE_UPLOAD" {
-			readFile(chanInput, cmdLine)
-		}
-		if cmd[0] != "HELLO" {
-			io.WriteString(conn, msgNoHello())
+	hello, failures := false, 0
+	session := ""
+	for input := range chanInput {
+		if input.tooLong != 0 {
+			send(msgLineTooLong(input.tooLong))
 			continue
 		}
-		if len(cmd) != 2 {
-			io.WriteString(conn, msgInvalidArgs("HELLO"))
+		client = selectCodec(input.line)
+		cmd, _, err := client.decode(input.line)
+		if err != nil {
+			send(msgInvalidJSON())
 			continue
 		}
-		if len(cmd[1]) == 0 {
-			io.WriteString(conn, msgInvalidUsrname())
+		if cmd[0] != "HELLO" && cmd[0] != "RESUME" {
+			send(msgNoHello())
+			continue
+		}
+		if len(cmd) < 2 || cmd[0] == "RESUME" && len(cmd) != 2 {
+			send(msgInvalidArgs(cmd[0]))
+			continue
+		}
+		if len(cmd[1]) == 0 || cmd[0] == "HELLO" && !validName(cmd[1]) {
+			send(msgInvalidUsrname())
 			continue
 		}
 		username := cmd[1]
-		server.chanName <- username
-		player = <-server.chanPlayer
+		req, ok := parseHello(username, cmd[2:])
+		if cmd[0] == "RESUME" {
+			// the session token stands for the name, see session.go
+			username, req = "", helloRequest{session: cmd[1]}
+		}
+		req.pc = pc
+		if !ok {
+			send(msgInvalidArgs("HELLO"))
+			continue
+		}
+		req.hashPassword(server)
+		server.chanName <- req
+		resp := <-server.chanPlayer
+		if resp.reason != "" {
+			send(msgAuthFail(username, resp.reason))
+			if failures++; failures >= AUTH_ATTEMPTS {
+				// no guessing passwords on one connection
+				break
+			}
+			continue
+		}
+		player = resp.player
+		session = resp.session
+		if resp.taken != nil {
+			// the player is still online on another connection, wait until
+			// it lets go of the player. A dead socket must not hold it up.
+			resp.taken.conn.SetWriteDeadline(time.Now().Add(time.Second))
+			select {
+			case resp.taken.detach <- true:
+			default:
+			}
+			<-resp.taken.gone
+		}
 		hello = true
+		if resp.token != "" {
+			send(msgResumeToken(player.name, resp.token))
+		}
 		break
 	}
 	if !hello {
 		conn.Close()
 		return nil
 	}
-	if len(player.gameIDs) == 0 {
-		io.WriteString(conn, msgWelcome(player.name, "", ""))
-	} else {
-		for gameID, gameChannel := range player.gameIDs {
-			infoRequest := map[string]string{
-				"cmd":  "RECONN",
-				"name": player.name,
-			}
-			gameChannel <- infoRequest
-
-			response := <-player.mailbox
-			if response["status"] != "success" {
-				// fails to reconnect
-				conn.Close()
-				return nil
-			}
+	// resume every game of the player, the welcomes follow once it is
+	// known which games are left
+	gameIDs := make([]string, 0, len(player.gameIDs))
+	for gameID := range player.gameIDs {
+		gameIDs = append(gameIDs, gameID)
+	}
+	sort.Strings(gameIDs)
+	resumed := make([]map[string]string, 0, len(gameIDs))
+	for _, gameID := range gameIDs {
+		gameChannel := player.gameIDs[gameID]
+		server.chanGameReq <- gameRequest{gameID: gameID, name: player.name}
+		if <-server.chanGameResp != gameChannel {
+			// closed while the player was away
+			delete(player.gameIDs, gameID)
+			continue
+		}
+		infoRequest := map[string]string{
+			"cmd":  "RECONN",
+			"name": player.name,
+		}
+		tell(gameChannel, infoRequest)
 
-			leader := response["leader"]
-			leaders[gameID] = leader
+		response := await()
+		if response["reason"] == "expired" {
+			// the seat was released while the player was away
+			delete(player.gameIDs, gameID)
+			continue
+		}
+		if response["status"] != "success" {
+			// fails to reconnect
+			conn.Close()
+			return nil
+		}
 
-			io.WriteString(conn, msgWelcome(player.name, gameID, response["state"]))
-			break
+		leader := response["leader"]
+		leaders[gameID] = leader
+		response["gameID"] = gameID
+		resumed = append(resumed, response)
+	}
+	for _, response := range resumed {
+		gameID := response["gameID"]
+		send(msgWelcome(player.name, gameID, response["state"], session))
+		if response["upload"] != "" {
+			send(msgUploadPending(gameID, response["upload"], response["offset"], response["size"]))
 		}
 	}
+	if len(resumed) == 0 {
+		send(msgWelcome(player.name, "", "", session))
+	}
 
 	disconn := false
 loop:
 	for {
+		inbox := player.mailbox
+		if len(replay) == 0 && len(early) > 0 {
+			replay <- early[0]
+			early = early[1:]
+		}
+		if len(replay) > 0 {
+			inbox = replay
+		}
 		select {
-		case cmdLine, more := <-chanInput:
+		case input, more := <-chanInput:
 			if !more {
 				disconn = true
 				break loop
 			}
-			cmd := strings.Split(cmdLine, " ")
+			if input.tooLong != 0 {
+				send(msgLineTooLong(input.tooLong))
+				continue
+			}
+			cmd, data, err := client.decode(input.line)
+			if err != nil {
+				send(msgInvalidJSON())
+				continue
+			}
 			switch cmd[0] {
 			case "NEW_GAME":
-				if len(cmd) != 2 {
-					io.WriteString(conn, msgInvalidArgs("NEW_GAME"))
+				if len(cmd) < 2 || !validFileName(cmd[1]) {
+					// the game ID names the game's directory
+					send(msgInvalidArgs("NEW_GAME"))
+					continue
+				}
+				rules, err := parseRules(cmd[2:])
+				if err != nil {
+					send(msgInvalidRules(err.Error()))
 					continue
 				}
-				req := struct {
-					gameID  string
-					name    string
-					newGame bool
-				}{
+				req := gameRequest{
 					gameID:  cmd[1],
 					name:    player.name,
 					newGame: true,
+					rules:   rules,
 				}
 				server.chanGameReq <- req
 				game := <-server.chanGameResp
 				if game == nil {
-					io.WriteString(conn, msgGameExists(cmd[1]))
+					send(msgGameExists(cmd[1]))
 					continue
 				}
-				io.WriteString(conn, msgGameCreated(cmd[1]))
 				player.gameIDs[cmd[1]] = game // add to joined games map
 				leaders[cmd[1]] = player.name
+				send(msgGameCreated(cmd[1], rules))
 
 			case "JOIN_GAME":
 				// Check if the command has the correct number of arguments
 				if len(cmd) != 2 {
-					io.WriteString(conn, msgInvalidArgs("JOIN_GAME"))
+					send(msgInvalidArgs("JOIN_GAME"))
 					continue
 				}
 				// Prepare a join game request
-				req := struct {
-					gameID  string
-					name    string
-					newGame bool
-				}{
+				req := gameRequest{
 					gameID:  cmd[1], // Game ID to join
 					name:    player.name,
 					newGame: false, // Indicates this is a join request, not a new game request
@@ -160,7 +537,7 @@ loop:
 
 				// Check if the game was successfully joined
 				if game == nil {
-					io.WriteString(conn, msgGameNotFound(cmd[1]))
+					send(msgGameNotFound(cmd[1]))
 					continue
 				}
 
@@ -170,10 +547,10 @@ loop:
 				}
 
 				// Send the message string to the game's logic
-				game <- request
+				tell(game, request)
 
 				// Wait for a response in the player's mailbox
-				response := <-player.mailbox
+				response := await()
 
 				// Process the response
 				status := response["status"]
@@ -181,16 +558,50 @@ loop:
 				if status == "success" {
 					// Update player's gameIDs map to include the joined game
 					player.gameIDs[cmd[1]] = game
-					io.WriteString(conn, msgGameJoined(cmd[1], response["state"]))
+					delete(player.watching, cmd[1])
+					rules, _ := parseRules(strings.Fields(response["rules"]))
+					send(msgGameJoined(cmd[1], response["state"], rules))
 					leaders[cmd[1]] = response["leader"]
 				} else {
-					io.WriteString(conn, msgJoinGameFail(cmd[1]))
+					send(msgJoinGameFail(cmd[1]))
 				}
 
+			case "WATCH_GAME":
+				if len(cmd) != 2 {
+					send(msgInvalidArgs("WATCH_GAME"))
+					continue
+				}
+
+				gameID := cmd[1]
+				req := gameRequest{
+					gameID:  gameID,
+					name:    player.name,
+					newGame: false,
+				}
+				server.chanGameReq <- req
+				game := <-server.chanGameResp
+				if game == nil {
+					send(msgGameNotFound(gameID))
+					continue
+				}
+
+				tell(game, map[string]string{
+					"cmd":  "WATCH",
+					"name": player.name,
+				})
+				response := await()
+				if response["status"] != "success" {
+					send(msgWatchGameFail(gameID, response["reason"]))
+					continue
+				}
+				player.watching[gameID] = game
+				leaders[gameID] = response["leader"]
+				send(msgWatching(gameID, response["state"]))
+
 			case "START_GAME":
 				// Check if the command has the correct number of arguments
 				if len(cmd) != 2 {
-					io.WriteString(conn, msgInvalidArgs("START_GAME"))
+					send(msgInvalidArgs("START_GAME"))
 					continue
 				}
 
@@ -199,11 +610,7 @@ loop:
 				game, ok := player.gameIDs[gameID]
 
 				if !ok {
-					req := struct {
-						gameID  string
-						name    string
-						newGame bool
-					}{
+					req := gameRequest{
 						gameID:  cmd[1], // Game ID to join
 						name:    player.name,
 						newGame: false, // Indicates this is a join request, not a new game request
@@ -211,7 +618,7 @@ loop:
 					server.chanGameReq <- req
 					game = <-server.chanGameResp
 					if game == nil {
-						io.WriteString(conn, msgGameNotFound(cmd[1]))
+						send(msgGameNotFound(cmd[1]))
 						continue
 					}
 				}
@@ -224,35 +631,46 @@ loop:
 				}
 
 				// Send the start game request to the game's logic
-				game <- request
+				tell(game, request)
 
 				// Wait for a response in the player's mailbox
-				response := <-player.mailbox
+				response := await()
 
 				// Process the response
 				status := response["status"]
 				if status == "success" {
-					io.WriteString(conn, msgGameStartedLeader(gameID))
+					send(msgGameStartedLeader(gameID))
 				} else {
 					// Handle failure to start game
 					reason := response["reason"]
 					wait := response["wait"]
 					leader := response["leader"]
-					io.WriteString(conn, msgStartGameFail(gameID, reason, wait, leader))
+					send(msgStartGameFail(gameID, reason, wait, leader))
 				}
 
 			case "FILE_UPLOAD":
+				if len(cmd) < 4 {
+					send(msgInvalidArgs("FILE_UPLOAD"))
+					continue
+				}
 				gameID := cmd[1]
 				fileName := cmd[2]
-				fileData := readFile(chanInput, cmdLine)
+				fileData, uploadErr := client.payload(input, data)
+				if uploadErr == "" {
+					uploadErr = checkUpload(cmd, fileData)
+				}
+				if uploadErr == "" && !validFileName(fileName) {
+					// the file goes to the game's directory and nowhere else
+					uploadErr = "invalid file name"
+				}
+				if uploadErr != "" {
+					send(msgUploadFail(gameID, uploadErr, cmd[3], len(fileData)))
+					continue
+				}
 				leader, ok := leaders[gameID]
 				if !ok {
 					// did not join the game
-					req := struct {
-						gameID  string
-						name    string
-						newGame bool
-					}{
+					req := gameRequest{
 						gameID:  gameID, // Game ID to join
 						name:    player.name,
 						newGame: false, // Indicates this is a join request, not a new game request
@@ -260,58 +678,162 @@ loop:
 					server.chanGameReq <- req
 					mailbox := <-server.chanGameResp
 					if mailbox == nil {
-						io.WriteString(conn, msgGameNotFound(gameID))
+						send(msgGameNotFound(gameID))
 						continue
 					}
 					request := map[string]string{"cmd": "INFO", "name": player.name}
-					mailbox <- request
-					response := <-player.mailbox
-					io.WriteString(conn, msgNonLeaderUpload(response["leader"]))
+					tell(mailbox, request)
+					response := await()
+					send(msgNonLeaderUpload(response["leader"]))
 					continue
 				}
 				if leader != player.name {
 					// joined the game but I am not the leader
-					io.WriteString(conn, msgNonLeaderUpload(leader))
+					send(msgNonLeaderUpload(leader))
 					continue
 				}
 				request := map[string]string{"cmd": "UPLOAD", "name": player.name, "filename": fileName}
-				mailbox := player.gameIDs[gameID]
-				mailbox <- request
-				response := <-player.mailbox
-				if response["status"] == "fail" {
+				for _, option := range cmd[4:] {
+					if key, value, _ := strings.Cut(option, "="); key == "format" || key == "columns" || key == "save" {
+						request[key] = value
+					}
+				}
+				// the game stores the file and unpacks archives
+				request["data"] = fileData
+				tell(player.gameIDs[gameID], request)
+				response := await()
+				if response["reason"] == "invalid file name" {
+					send(msgUploadFail(gameID, response["reason"], cmd[3], 0))
+					continue
+				}
+				if response["status"] == "fail" && response["reason"] == "" {
 					// a file with the same name exists
-					io.WriteString(conn, msgFileExists(gameID, fileName))
+					send(msgFileExists(gameID, fileName))
 					continue
 				}
-				f, err := os.Create(response["path"] + fileName)
-				if err != nil {
-					// unable to create the file, return a fail to the game
-					mailbox <- map[string]string{"status": "fail"}
+				if response["status"] != "success" {
+					send(msgUploadSessionFail(gameID, response))
 					continue
 				}
-				f.WriteString(fileData)
-				f.Close()
-				// tell the game the upload is complete
-				mailbox <- map[string]string{"status": "success"}
+				send(msgUploadAccepted(gameID, fileName))
 				// do not print anything here, wait for the server's notification
 
+			case "UPLOAD_BEGIN", "UPLOAD_CHUNK", "UPLOAD_COMMIT", "USE_CORPUS":
+				request := map[string]string{"cmd": cmd[0], "name": player.name}
+				switch {
+				case cmd[0] == "UPLOAD_BEGIN" && len(cmd) >= 4:
+					size, err := strconv.Atoi(cmd[3])
+					if err != nil || size < 0 {
+						send(msgUploadFail(cmd[1], "invalid size", cmd[3], 0))
+						continue
+					}
+					if size > MAX_CORPUS_SIZE {
+						send(msgUploadFail(cmd[1], "corpus too large", cmd[3], 0))
+						continue
+					}
+					if !validFileName(cmd[2]) {
+						send(msgUploadFail(cmd[1], "invalid file name", cmd[3], 0))
+						continue
+					}
+					request["filename"], request["size"] = cmd[2], cmd[3]
+					reason := uploadOptions(cmd[4:], request, "sha256", "format", "columns", "save")
+					if reason == "unknown option" {
+						send(msgInvalidArgs(cmd[0]))
+						continue
+					} else if reason != "" {
+						send(msgUploadFail(cmd[1], reason, cmd[3], 0))
+						continue
+					}
+				case cmd[0] == "USE_CORPUS" && len(cmd) >= 3:
+					if !validFileName(cmd[2]) {
+						// the corpus is put in the game's directory under its name
+						send(msgUploadFail(cmd[1], "invalid file name", "", 0))
+						continue
+					}
+					request["corpus"] = cmd[2]
+					reason := uploadOptions(cmd[3:], request, "format", "columns")
+					if reason == "unknown option" {
+						send(msgInvalidArgs(cmd[0]))
+						continue
+					} else if reason != "" {
+						send(msgUploadFail(cmd[1], reason, "", 0))
+						continue
+					}
+				case cmd[0] == "UPLOAD_CHUNK" && len(cmd) >= 4:
+					chunk, uploadErr := client.payload(input, data)
+					if uploadErr == "" {
+						uploadErr = checkUpload(cmd, chunk)
+					}
+					if uploadErr != "" {
+						send(msgUploadFail(cmd[1], uploadErr, cmd[3], len(chunk)))
+						continue
+					}
+					request["offset"], request["data"] = cmd[2], chunk
+				case cmd[0] == "UPLOAD_COMMIT" && len(cmd) == 2:
+				default:
+					send(msgInvalidArgs(cmd[0]))
+					continue
+				}
+
+				gameID := cmd[1]
+				game, ok := player.gameIDs[gameID]
+				if !ok {
+					req := gameRequest{
+						gameID:  gameID,
+						name:    player.name,
+						newGame: false,
+					}
+					server.chanGameReq <- req
+					game = <-server.chanGameResp
+					if game == nil {
+						send(msgGameNotFound(gameID))
+						continue
+					}
+				}
+				tell(game, request)
+				response := await()
+				if response["status"] != "success" {
+					send(msgUploadSessionFail(gameID, response))
+					continue
+				}
+				switch cmd[0] {
+				case "UPLOAD_BEGIN":
+					send(msgUploadBegun(gameID, response["filename"], response["offset"], response["size"]))
+				case "UPLOAD_CHUNK":
+					send(msgChunkReceived(gameID, response["filename"], response["offset"], response["size"]))
+				default:
+					// text clients wait for UPLOADED like after FILE_UPLOAD
+					send(msgUploadAccepted(gameID, response["filename"]))
+				}
+
+			case "SESSION":
+				if len(cmd) != 1 {
+					send(msgInvalidArgs("SESSION"))
+					continue
+				}
+				send(msgSession(session))
+
+			case "LIST_CORPORA":
+				if len(cmd) != 1 {
+					send(msgInvalidArgs("LIST_CORPORA"))
+					continue
+				}
+				send(msgCorpora(server.libraryCall(libraryRequest{op: "list"}).corpora))
+
 			case "RANDOM_WORD":
 				if len(cmd) < 3 {
-					io.WriteString(conn, msgInvalidArgs("RANDOM_WORD"))
+					send(msgInvalidArgs("RANDOM_WORD"))
 					continue
 				}
 
-				gameID, word := cmd[1], cmd[2]
+				// several words in rounds with the "words" rule
+				gameID, word := cmd[1], strings.Join(cmd[2:], " ")
 
 				// The game to which the word is being set
 				game, ok := player.gameIDs[gameID]
 				if !ok {
 					// Game not found in player's current games, request it from the server
-					req := struct {
-						gameID  string
-						name    string
-						newGame bool
-					}{
+					req := gameRequest{
 						gameID:  gameID,
 						name:    player.name,
 						newGame: false,
@@ -321,10 +843,10 @@ loop:
 
 					if game == nil {
 						// Game does not exist
-						io.WriteString(conn, msgGameNotFound(gameID))
+						send(msgGameNotFound(gameID))
 						continue
 					} else {
-						io.WriteString(conn, msgInvalidCmd())
+						send(msgInvalidCmd())
 						continue
 					}
 				}
@@ -335,35 +857,63 @@ loop:
 					"name": player.name,
 					"word": word,
 				}
-				game <- wordRequest
+				tell(game, wordRequest)
 
 				// Wait for a response from the game logic
-				response := <-player.mailbox
+				response := await()
 
 				// Handle the response
 				if response["status"] != "success" {
-					reason := response["reason"]
-					picker := response["picker"]
-					io.WriteString(conn, msgWordSetFail(reason, word, picker, response["leader"]))
+					if response["word"] == "" {
+						response["word"] = word
+					}
+					send(msgWordSetFail(response))
+					continue
 				}
+				send(msgWordSet(gameID, response["word"]))
+
+			case "HINTS":
+				if len(cmd) != 2 {
+					send(msgInvalidArgs("HINTS"))
+					continue
+				}
+				gameID := cmd[1]
+				game, ok := player.gameIDs[gameID]
+				if !ok {
+					req := gameRequest{
+						gameID:  gameID,
+						name:    player.name,
+						newGame: false,
+					}
+					server.chanGameReq <- req
+					game = <-server.chanGameResp
+					if game == nil {
+						send(msgGameNotFound(gameID))
+						continue
+					}
+				}
+				tell(game, map[string]string{"cmd": "HINTS", "name": player.name})
+				response := await()
+				if response["status"] != "success" {
+					send(msgHintsFail(gameID, response))
+					continue
+				}
+				send(msgHints(gameID, response))
 
 			case "WORD_COUNT":
-				if len(cmd) != 3 {
-					io.WriteString(conn, msgInvalidArgs("WORD_COUNT"))
+				if len(cmd) < 3 {
+					send(msgInvalidArgs("WORD_COUNT"))
 					continue
 				}
 
-				gameID, guess := cmd[1], cmd[2]
+				// a count per word in rounds with the "words" rule
+				gameID, guess := cmd[1], strings.Join(cmd[2:], ",")
 
 				// Check if the player is part of the specified game
 				game, ok := player.gameIDs[gameID]
 				if !ok {
 					// Player is not part of the game, request game info from server
-					req := struct {
-						gameID  string
-						name    string
-						newGame bool
-					}{
+					req := gameRequest{
 						gameID:  gameID,
 						name:    player.name,
 						newGame: false,
@@ -372,7 +922,7 @@ loop:
 					game = <-server.chanGameResp
 
 					if game == nil {
-						io.WriteString(conn, msgGameNotFound(cmd[1]))
+						send(msgGameNotFound(cmd[1]))
 						continue
 					}
 				}
@@ -383,20 +933,22 @@ loop:
 					"name":  player.name,
 					"guess": guess,
 				}
-				game <- guessRequest
+				tell(game, guessRequest)
 
 				// Wait for a response from the game logic
-				response := <-player.mailbox
+				response := await()
 
 				// Handle the response
 				if response["status"] != "success" {
 					reason := response["reason"]
-					io.WriteString(conn, msgWordCountFail(reason, cmd[1]))
+					send(msgWordCountFail(reason, cmd[1], response["words"]))
+					continue
 				}
+				send(msgGuessRecorded(gameID, guess))
 
 			case "RESTART":
 				if len(cmd) != 2 {
-					io.WriteString(conn, msgInvalidArgs("RESTART"))
+					send(msgInvalidArgs("RESTART"))
 					continue
 				}
 
@@ -406,11 +958,7 @@ loop:
 				game, ok := player.gameIDs[gameID]
 				if !ok {
 					// Player is not part of the game, request game info from server
-					req := struct {
-						gameID  string
-						name    string
-						newGame bool
-					}{
+					req := gameRequest{
 						gameID:  gameID,
 						name:    player.name,
 						newGame: false,
@@ -419,7 +967,7 @@ loop:
 					game = <-server.chanGameResp
 
 					if game == nil {
-						io.WriteString(conn, msgGameNotFound(cmd[1]))
+						send(msgGameNotFound(cmd[1]))
 						continue
 					}
 				}
@@ -429,19 +977,19 @@ loop:
 					"cmd":  "RESTART",
 					"name": player.name,
 				}
-				game <- restartRequest
+				tell(game, restartRequest)
 
 				// Wait for a response from the game logic
-				response := <-player.mailbox
+				response := await()
 
 				// Handle the response
 				if response["status"] != "success" {
-					io.WriteString(conn, msgGameRestartFail(leaders[gameID]))
+					send(msgGameRestartFail(gameID, response["reason"], response["leader"], response["rounds"]))
 				}
 
 			case "CLOSE":
 				if len(cmd) != 2 {
-					io.WriteString(conn, msgInvalidArgs("CLOSE"))
+					send(msgInvalidArgs("CLOSE"))
 					continue
 				}
 
@@ -451,11 +999,7 @@ loop:
 				game, ok := player.gameIDs[gameID]
 				if !ok {
 					// Player is not part of the game, request game info from server
-					req := struct {
-						gameID  string
-						name    string
-						newGame bool
-					}{
+					req := gameRequest{
 						gameID:  gameID,
 						name:    player.name,
 						newGame: false,
@@ -464,7 +1008,7 @@ loop:
 					game = <-server.chanGameResp
 
 					if game == nil {
-						io.WriteString(conn, msgGameNotFound(cmd[1]))
+						send(msgGameNotFound(cmd[1]))
 						continue
 					}
 				}
@@ -475,19 +1019,190 @@ loop:
 					"gameID": gameID,
 					"name":   player.name,
 				}
-				game <- closeRequest
+				tell(game, closeRequest)
 
 				// Wait for a response from the game logic
-				response := <-player.mailbox
+				response := await()
 
 				// Handle the response
 				if response["status"] != "success" {
-					io.WriteString(conn, msgGameCloseFail(leaders[gameID]))
+					send(msgGameCloseFail(leaders[gameID]))
 				}
 				// clear info about the game
 				delete(player.gameIDs, gameID)
 				delete(leaders, gameID)
 
+			case "SCORES":
+				if len(cmd) != 2 {
+					send(msgInvalidArgs("SCORES"))
+					continue
+				}
+
+				gameID := cmd[1]
+
+				game, ok := player.gameIDs[gameID]
+				if !ok {
+					// anyone may look at the scores of a game
+					req := gameRequest{
+						gameID:  gameID,
+						name:    player.name,
+						newGame: false,
+					}
+					server.chanGameReq <- req
+					game = <-server.chanGameResp
+
+					if game == nil {
+						send(msgGameNotFound(cmd[1]))
+						continue
+					}
+				}
+
+				tell(game, map[string]string{
+					"cmd":  "SCORES",
+					"name": player.name,
+				})
+				response := await()
+				round, _ := strconv.Atoi(response["round"])
+				send(msgScores(gameID, round, parseScores(response["scores"])))
+
+			case "SAY":
+				if len(cmd) < 3 {
+					send(msgInvalidArgs("SAY"))
+					continue
+				}
+				gameID := cmd[1]
+				text, reason := chatText(cmd[2:])
+				if reason != "" {
+					send(msgChatFail(reason, gameID, ""))
+					continue
+				}
+				if text == "" {
+					send(msgInvalidArgs("SAY"))
+					continue
+				}
+
+				game, ok := player.gameIDs[gameID]
+				if !ok {
+					req := gameRequest{
+						gameID:  gameID,
+						name:    player.name,
+						newGame: false,
+					}
+					server.chanGameReq <- req
+					if <-server.chanGameResp == nil {
+						send(msgGameNotFound(gameID))
+					} else {
+						// spectators and strangers cannot talk to the players
+						send(msgChatFail("did not join the game", gameID, ""))
+					}
+					continue
+				}
+
+				tell(game, map[string]string{
+					"cmd":  "SAY",
+					"name": player.name,
+					"text": text,
+				})
+				response := await()
+				if response["status"] != "success" {
+					send(msgChatFail(response["reason"], gameID, ""))
+					continue
+				}
+				send(msgChatSent(gameID))
+
+			case "WHISPER":
+				if len(cmd) < 3 {
+					send(msgInvalidArgs("WHISPER"))
+					continue
+				}
+				to := cmd[1]
+				text, reason := chatText(cmd[2:])
+				if reason != "" {
+					send(msgChatFail(reason, "", to))
+					continue
+				}
+				if text == "" {
+					send(msgInvalidArgs("WHISPER"))
+					continue
+				}
+
+				server.chanChatReq <- to
+				chat := <-server.chanChatResp
+				if chat == nil {
+					send(msgPlayerNotFound(to))
+					continue
+				}
+				whisper := map[string]string{"msg": "WHISPER", "from": player.name, "text": text}
+				select {
+				case chat <- whisper:
+					send(msgWhisperSent(to))
+				default:
+					// never block on a player that does not read its whispers
+					send(msgChatFail("inbox full", "", to))
+				}
+
+			case "MUTE", "UNMUTE":
+				if len(cmd) != 2 {
+					send(msgInvalidArgs(cmd[0]))
+					continue
+				}
+				// muting only filters what this player is shown
+				if cmd[0] == "MUTE" {
+					player.muted[cmd[1]] = true
+				} else {
+					delete(player.muted, cmd[1])
+				}
+				send(msgMuted(cmd[1], cmd[0] == "MUTE"))
+
+			case "LIST_GAMES":
+				filter, ok := parseLobbyFilter(cmd[1:])
+				if !ok {
+					send(msgInvalidArgs("LIST_GAMES"))
+					continue
+				}
+				send(msgGames(server.listGames(filter)))
+
+			case "WATCH_LOBBY", "UNWATCH_LOBBY":
+				if len(cmd) != 1 {
+					send(msgInvalidArgs(cmd[0]))
+					continue
+				}
+				op := "watch"
+				if cmd[0] == "UNWATCH_LOBBY" {
+					op = "unwatch"
+				}
+				server.chanLobbyReq <- lobbyRequest{op: op, name: player.name, news: player.lobby}
+				send(msgLobbyWatch(cmd[0] == "WATCH_LOBBY"))
+
+			case "MY_GAMES":
+				if len(cmd) != 1 {
+					send(msgInvalidArgs("MY_GAMES"))
+					continue
+				}
+				gameIDs := make([]string, 0, len(player.gameIDs)+len(player.watching))
+				for gameID := range player.gameIDs {
+					gameIDs = append(gameIDs, gameID)
+				}
+				for gameID := range player.watching {
+					gameIDs = append(gameIDs, gameID)
+				}
+				sort.Strings(gameIDs)
+				games := make([]map[string]string, 0, len(gameIDs))
+				for _, gameID := range gameIDs {
+					gameChannel, ok := player.gameIDs[gameID]
+					if !ok {
+						gameChannel = player.watching[gameID]
+					}
+					tell(gameChannel, map[string]string{"cmd": "STATUS", "name": player.name})
+					response := await()
+					if response["status"] != "success" {
+						continue
+					}
+					response["gameID"] = gameID
+					games = append(games, response)
+				}
+				send(msgMyGames(games))
+
 			case "GOODBYE":
 				for gameID, gameChannel := range player.gameIDs {
 					closeRequest := map[string]string{
@@ -495,55 +1210,109 @@ loop:
 						"gameID": gameID,
 						"name":   player.name,
 					}
-					gameChannel <- closeRequest
-					<-player.mailbox
+					tell(gameChannel, closeRequest)
+					await()
+					// left, the game is none of the player's games any more
+					delete(player.gameIDs, gameID)
+					delete(leaders, gameID)
 				}
-				io.WriteString(conn, msgBye())
+				send(msgBye())
 
 			default:
-				io.WriteString(conn, msgInvalidCmd())
+				send(msgInvalidCmd())
+			}
+
+		case <-pc.detach:
+			// HELLO on another connection took over the player
+			send(msgTakenOver(player.name))
+			conn.Close()
+			go func() {
+				for range chanInput {
+				}
+			}()
+			disconn = true
+			break loop
+
+		case news := <-player.lobby:
+			send(msgLobbyNews(news["msg"], newLobbyEntry(news)))
+
+		case whisper := <-player.chat:
+			if !player.muted[whisper["from"]] {
+				send(msgWhisper(whisper["from"], whisper["text"]))
 			}
 
-		case notification := <-player.mailbox:
+		case notification := <-inbox:
 			switch notification["msg"] {
 			case "READY":
-				io.WriteString(conn, msgGameReady(notification["gameID"]))
+				send(msgGameReady(notification["gameID"]))
 			case "STARTED":
-				io.WriteString(conn, msgGameStartedNonLeader(notification["gameID"], notification["leader"]))
+				send(msgGameStartedNonLeader(notification["gameID"], notification["leader"]))
 			case "UPLOADED":
-				io.WriteString(conn, msgFileUploadedNonPicker())
+				send(msgFileUploadedNonPicker(notification["gameID"]))
 			case "PICK":
-				io.WriteString(conn, msgFileUploadedPicker(notification["filename"]))
+				send(msgFileUploadedPicker(notification["gameID"], notification["filename"], notification["files"]))
 			case "NEW_LEADER":
 				gameID := notification["gameID"]
 				leader := notification["leader"]
 				leaders[gameID] = leader
-				if player.name == leader {
-					io.WriteString(conn, msgBecomeNewLeader(gameID))
-				}
+				send(msgNewLeader(gameID, leader, player.name == leader))
 			case "WORD_SELECTED":
-				io.WriteString(conn, msgWordSetSuccess(notification["word"]))
+				if _, ok := player.watching[notification["gameID"]]; ok {
+					send(msgWordSelectedSpectator(notification["gameID"], notification["word"]))
+				} else {
+					send(msgWordSetSuccess(notification["gameID"], notification["word"]))
+				}
 			case "WINNER":
 				gameID := notification["gameID"]
-				if player.name == notification["name"] {
-					io.WriteString(conn, msgIsWinner())
+				result := newRoundResult(notification)
+				if _, ok := player.watching[gameID]; ok {
+					send(msgRoundOver(result))
+				} else if result.won(player.name) {
+					send(msgIsWinner(result, player.name))
 				} else {
-					io.WriteString(conn, msgIsLoser())
+					send(msgIsLoser(result))
 				}
 				time.Sleep(1 * time.Second) // make the test happy
 				if leaders[gameID] == player.name {
-					io.WriteString(conn, msgRestartOrClose(gameID))
+					send(msgRestartOrClose(result))
+				}
+			case "NO_WORD":
+				send(msgNoWord(notification["gameID"], notification["leader"]))
+			case "EXPIRED":
+				send(msgExpired(notification["gameID"], notification["name"]))
+			case "TIMEOUT":
+				gameID := notification["gameID"]
+				if notification["phase"] == "pick" {
+					send(msgPickTimeout(gameID, notification["name"], notification["picker"]))
+				} else {
+					missing := make([]string, 0)
+					if notification["missing"] != "" {
+						missing = strings.Split(notification["missing"], ",")
+					}
+					send(msgGuessTimeout(gameID, missing))
+				}
+			case "CHAT":
+				if !player.muted[notification["from"]] {
+					send(msgChat(notification["gameID"], notification["from"], notification["text"]))
 				}
 			case "RESTARTED":
-				io.WriteString(conn, msgGameRestarted())
+				send(msgGameRestarted(notification["gameID"]))
+			case "PROMOTED":
+				gameID := notification["gameID"]
+				player.gameIDs[gameID] = player.watching[gameID]
+				delete(player.watching, gameID)
+				leaders[gameID] = notification["leader"]
+				send(msgPromoted(gameID, notification["state"]))
 			case "CLOSED":
 				gameID := notification["gameID"]
-				io.WriteString(conn, msgBye())
+				send(msgGameClosed(gameID))
 				delete(player.gameIDs, gameID)
+				delete(player.watching, gameID)
 				delete(leaders, gameID)
 			case "EXIT":
 				gameID := notification["gameID"]
 				delete(player.gameIDs, gameID)
+				delete(player.watching, gameID)
 				delete(leaders, gameID)
 				break loop
 			}
@@ -551,17 +1320,78 @@ loop:
 	}
 
 	if disconn {
-		// disconnected, tell the game
+		// disconnected, tell the games and then the server. Until the
+		// server knows this connection is gone a HELLO for the player
+		// waits on it, so no other connection reads the mailbox meanwhile.
+		mailboxes := make(map[string]chan map[string]string, len(player.gameIDs))
+		for gameID, mailbox := range player.gameIDs {
+			mailboxes[gameID] = mailbox
+		}
+		// spectators do not resume watching
+		watched := player.watching
+		player.watching = make(map[string]chan map[string]string)
+		// the games may be telling the player something meanwhile, too
+		// late. A game that ended does not listen any more, a spectator
+		// that got a seat holds it like the other games.
+		drop := func(notification map[string]string) {
+			gameID := notification["gameID"]
+			switch notification["msg"] {
+			case "EXIT", "CLOSED":
+				delete(mailboxes, gameID)
+				delete(watched, gameID)
+			case "PROMOTED":
+				if mailbox, ok := watched[gameID]; ok {
+					mailboxes[gameID] = mailbox
+					player.gameIDs[gameID] = mailbox
+					delete(watched, gameID)
+				}
+			}
+		}
+		// stop watching first, a game may seat the player until it has
+		// the UNWATCH. The games with a seat are told after that.
+		unwatch := map[string]string{"cmd": "UNWATCH", "name": player.name}
+		for gameID, mailbox := range watched {
+			for sent := false; !sent; {
+				if _, ok := watched[gameID]; !ok {
+					break
+				}
+				select {
+				case mailbox <- unwatch:
+					sent = true
+				case notification := <-player.mailbox:
+					drop(notification)
+				}
+			}
+		}
 		request := map[string]string{"cmd": "DISCONN", "name": player.name}
-		for _, mailbox := range player.gameIDs {
-			mailbox <- request
+		for gameID, mailbox := range mailboxes {
+			for sent := false; !sent; {
+				if _, ok := mailboxes[gameID]; !ok {
+					break
+				}
+				select {
+				case mailbox <- request:
+					sent = true
+				case notification := <-player.mailbox:
+					drop(notification)
+				}
+			}
+		}
+		for sent := false; !sent; {
+			select {
+			case server.chanOnline <- playerConn{name: player.name, conn: conn}:
+				sent = true
+			case notification := <-player.mailbox:
+				drop(notification)
+			}
 		}
 	} else {
 		// exit
-		for len(player.gameIDs) > 0 {
+		for len(player.gameIDs)+len(player.watching) > 0 {
 			notification := <-player.mailbox
 			gameID := notification["gameID"]
 			delete(player.gameIDs, gameID)
+			delete(player.watching, gameID)
 			delete(leaders, gameID)
 		}
 		conn.Close()
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// codec translates between one connection's wire format and the
+// command arguments and messages used by clientRoutine. The format is
+// chosen by the HELLO line: a JSON object selects jsonCodec, anything
+// else keeps the space separated textCodec.
+type codec interface {
+	// decode splits a command line into the command name followed by its
+	// arguments, plus any payload carried inline by the command.
+	decode(line string) (cmd []string, data string, err error)
+	// encode renders a message, an empty string means nothing is sent.
+	encode(m message) string
+	// payload returns the file data of a FILE_UPLOAD command and why it
+	// was not received in full, "" if it was.
+	payload(input clientInput, data string) (string, string)
+}
+
+// selectCodec returns the codec implied by the first line of a session.
+func selectCodec(line string) codec {
+	if strings.HasPrefix(strings.TrimSpace(line), "{") {
+		return jsonCodec{}
+	}
+	return textCodec{}
+}
+
+// textCodec is the original protocol: space separated commands and
+// plain English responses, one per line.
+type textCodec struct{}
+
+func (textCodec) decode(line string) ([]string, string, error) {
+	return strings.Split(line, " "), "", nil
+}
+
+func (textCodec) encode(m message) string {
+	return m.text
+}
+
+func (textCodec) payload(input clientInput, data string) (string, string) {
+	return input.payload, input.uploadErr
+}
+
+// jsonArgs lists, for each command, the JSON keys holding its positional
+// arguments in the order the text protocol expects them.
+var jsonArgs = map[string][]string{
+	"HELLO":         {"name"},
+	"RESUME":        {"session"},
+	"SESSION":       {},
+	"NEW_GAME":      {"gameID"},
+	"JOIN_GAME":     {"gameID"},
+	"WATCH_GAME":    {"gameID"},
+	"START_GAME":    {"gameID"},
+	"FILE_UPLOAD":   {"gameID", "filename", "size"},
+	"UPLOAD_BEGIN":  {"gameID", "filename", "size"},
+	"UPLOAD_CHUNK":  {"gameID", "offset", "size"},
+	"UPLOAD_COMMIT": {"gameID"},
+	"USE_CORPUS":    {"gameID", "corpus"},
+	"LIST_CORPORA":  {},
+	"RANDOM_WORD":   {"gameID", "word"},
+	"HINTS":         {"gameID"},
+	"WORD_COUNT":    {"gameID", "guess"},
+	"RESTART":       {"gameID"},
+	"CLOSE":         {"gameID"},
+	"SCORES":        {"gameID"},
+	"SAY":           {"gameID", "text"},
+	"WHISPER":       {"to", "text"},
+	"MUTE":          {"name"},
+	"UNMUTE":        {"name"},
+	"MY_GAMES":      {},
+	"LIST_GAMES":    {},
+	"WATCH_LOBBY":   {},
+	"UNWATCH_LOBBY": {},
+	"GOODBYE":       {},
+}
+
+// jsonCodec speaks newline delimited JSON. Every command is an object
+// with a "cmd" key, e.g. {"cmd": "NEW_GAME", "gameID": "abc", "min": 2},
+// where keys beyond the positional arguments become key=value options.
+// Every message is an object with "type", "event" and "text" keys plus
+// the fields of the event.
+type jsonCodec struct{}
+
+func (jsonCodec) decode(line string) ([]string, string, error) {
+	obj := make(map[string]interface{})
+	decoder := json.NewDecoder(strings.NewReader(line))
+	decoder.UseNumber()
+	if err := decoder.Decode(&obj); err != nil {
+		return nil, "", err
+	}
+	name, ok := obj["cmd"].(string)
+	if !ok {
+		return nil, "", errors.New("missing cmd")
+	}
+	cmd := []string{name}
+	data, _ := obj["data"].(string)
+	if name == "FILE_UPLOAD" || name == "UPLOAD_CHUNK" {
+		if _, ok := obj["size"]; !ok {
+			obj["size"] = json.Number(fmt.Sprint(len(data)))
+		}
+	}
+	positional := map[string]bool{"cmd": true, "data": true}
+	for _, key := range jsonArgs[name] {
+		value, ok := obj[key]
+		if !ok || value == nil {
+			// missing argument, leave it to the command to complain
+			return cmd, data, nil
+		}
+		if values, ok := value.([]interface{}); ok {
+			// a list, e.g. the guesses of a round with several words
+			for _, v := range values {
+				cmd = append(cmd, fmt.Sprint(v))
+			}
+		} else {
+			cmd = append(cmd, fmt.Sprint(value))
+		}
+		positional[key] = true
+	}
+	// any other key is an option, passed on as key=value like in text
+	options := make([]string, 0)
+	for key, value := range obj {
+		if !positional[key] {
+			options = append(options, key+"="+fmt.Sprint(value))
+		}
+	}
+	sort.Strings(options)
+	return append(cmd, options...), data, nil
+}
+
+func (jsonCodec) encode(m message) string {
+	obj := make(map[string]interface{}, len(m.fields)+3)
+	for k, v := range m.fields {
+		obj[k] = v
+	}
+	obj["type"] = m.kind
+	obj["event"] = m.event
+	obj["text"] = strings.TrimSuffix(m.text, "\n")
+	line, err := json.Marshal(obj)
+	if err != nil {
+		return ""
+	}
+	return string(line) + "\n"
+}
+
+func (jsonCodec) payload(input clientInput, data string) (string, string) {
+	// the whole line has been read, checkUpload compares it with the size
+	return data, ""
+}
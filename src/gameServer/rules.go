@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gameRules are the rules a leader chooses for a game at NEW_GAME, given
+// as key=value arguments after the game tag, e.g.
+//
+//	NEW_GAME abc min=2 max=4 rounds=3 timeout=30 pickTimeout=60 leaderGuess=no ties=shared tokenizer=fold
+//	NEW_GAME abc minLength=4 minCount=2 maxCount=50 stopWords=english
+//	NEW_GAME abc picker=server seed=42 words=3
+//
+// The pick rules, minLength to stopWords, are explained in hints.go.
+type gameRules struct {
+	minPlayers   int           // players needed to start, "min"
+	maxPlayers   int           // players the game can hold, "max"
+	rounds       int           // rounds before the game must close, 0 for no limit, "rounds"
+	guessTimeout time.Duration // time to guess once the word is selected, 0 for no limit, "timeout" in seconds
+	pickTimeout  time.Duration // time to pick once the file is uploaded, 0 for no limit, "pickTimeout" in seconds
+	leaderGuess  bool          // whether the leader guesses too, "leaderGuess"
+	ties         string        // TIES_FIRST or TIES_SHARED, "ties"
+	tokenizer    string        // how the words of the file are counted, see tokenize.go, "tokenizer"
+	minLength    int           // fewest letters of a picked word, "minLength"
+	minCount     int           // fewest times a picked word is counted, "minCount"
+	maxCount     int           // most times a picked word is counted, 0 for no limit, "maxCount"
+	stopWords    string        // words that may not be picked, "stopWords"
+	picker       string        // PICKER_PLAYER or PICKER_SERVER, "picker"
+	seed         int64         // seeds the words the server picks, 0 for unseeded, "seed"
+	words        int           // target words of a round, "words"
+}
+
+// who picks the word of a round
+const (
+	PICKER_PLAYER string = "player" // a player other than the leader, asked with PICK
+	PICKER_SERVER string = "server" // the server, as soon as the words are counted
+)
+
+// tie policies, who wins when several guesses are equally close
+const (
+	TIES_FIRST  string = "first"  // the earliest of the closest guesses wins
+	TIES_SHARED string = "shared" // all of the closest guesses win
+)
+
+func defaultRules() gameRules {
+	return gameRules{
+		minPlayers:   MIN_PLAYERS,
+		maxPlayers:   MAX_PLAYERS,
+		guessTimeout: time.Duration(GUESS_TIMEOUT) * time.Second,
+		pickTimeout:  time.Duration(PICK_TIMEOUT) * time.Second,
+		leaderGuess:  true,
+		ties:         TIES_FIRST,
+		tokenizer:    TOKENS_WHITESPACE,
+		picker:       PICKER_PLAYER,
+		words:        1,
+	}
+}
+
+// parseRules reads key=value arguments on top of the default rules and
+// validates the result.
+func parseRules(args []string) (gameRules, error) {
+	rules := defaultRules()
+	for _, arg := range args {
+		if arg == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return rules, fmt.Errorf("%s is not a key=value rule", arg)
+		}
+		var err error
+		switch key {
+		case "min":
+			rules.minPlayers, err = strconv.Atoi(value)
+		case "max":
+			rules.maxPlayers, err = strconv.Atoi(value)
+		case "rounds":
+			rules.rounds, err = strconv.Atoi(value)
+		case "timeout":
+			var seconds int
+			seconds, err = strconv.Atoi(value)
+			rules.guessTimeout = time.Duration(seconds) * time.Second
+		case "pickTimeout":
+			var seconds int
+			seconds, err = strconv.Atoi(value)
+			rules.pickTimeout = time.Duration(seconds) * time.Second
+		case "leaderGuess":
+			rules.leaderGuess, err = parseYesNo(value)
+		case "ties":
+			if value != TIES_FIRST && value != TIES_SHARED {
+				err = fmt.Errorf("unknown tie policy %s", value)
+			}
+			rules.ties = value
+		case "tokenizer":
+			if _, ok := tokenizers[value]; !ok {
+				err = fmt.Errorf("unknown tokenizer %s", value)
+			}
+			rules.tokenizer = value
+		case "minLength":
+			rules.minLength, err = strconv.Atoi(value)
+		case "minCount":
+			rules.minCount, err = strconv.Atoi(value)
+		case "maxCount":
+			rules.maxCount, err = strconv.Atoi(value)
+		case "stopWords":
+			if value == "none" {
+				value = ""
+			}
+			rules.stopWords = value
+		case "picker":
+			if value != PICKER_PLAYER && value != PICKER_SERVER {
+				err = fmt.Errorf("unknown picker %s", value)
+			}
+			rules.picker = value
+		case "seed":
+			rules.seed, err = strconv.ParseInt(value, 10, 64)
+		case "words":
+			rules.words, err = strconv.Atoi(value)
+		default:
+			return rules, fmt.Errorf("unknown rule %s", key)
+		}
+		if err != nil {
+			return rules, fmt.Errorf("invalid value %s for rule %s", value, key)
+		}
+	}
+	// the leader uploads and someone else picks, so a game needs two players
+	if rules.minPlayers < 2 {
+		return rules, fmt.Errorf("min must be at least 2")
+	}
+	if rules.maxPlayers < rules.minPlayers {
+		return rules, fmt.Errorf("max must not be less than min")
+	}
+	if rules.rounds < 0 {
+		return rules, fmt.Errorf("rounds must not be negative")
+	}
+	if rules.guessTimeout < 0 {
+		return rules, fmt.Errorf("timeout must not be negative")
+	}
+	if rules.pickTimeout < 0 {
+		return rules, fmt.Errorf("pickTimeout must not be negative")
+	}
+	if rules.minLength < 0 || rules.minCount < 0 || rules.maxCount < 0 {
+		return rules, fmt.Errorf("minLength, minCount and maxCount must not be negative")
+	}
+	if rules.maxCount > 0 && rules.maxCount < rules.minCount {
+		return rules, fmt.Errorf("maxCount must not be less than minCount")
+	}
+	if rules.words < 1 || rules.words > MAX_ROUND_WORDS {
+		return rules, fmt.Errorf("words must be between 1 and %d", MAX_ROUND_WORDS)
+	}
+	return rules, nil
+}
+
+func parseYesNo(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "yes", "true", "1":
+		return true, nil
+	case "no", "false", "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("%s is neither yes nor no", value)
+}
+
+// args renders the rules in the form parseRules reads.
+func (rules gameRules) args() []string {
+	leaderGuess := "no"
+	if rules.leaderGuess {
+		leaderGuess = "yes"
+	}
+	stopWords := rules.stopWords
+	if stopWords == "" {
+		stopWords = "none"
+	}
+	return []string{
+		"min=" + strconv.Itoa(rules.minPlayers),
+		"max=" + strconv.Itoa(rules.maxPlayers),
+		"rounds=" + strconv.Itoa(rules.rounds),
+		"timeout=" + strconv.Itoa(int(rules.guessTimeout/time.Second)),
+		"pickTimeout=" + strconv.Itoa(int(rules.pickTimeout/time.Second)),
+		"leaderGuess=" + leaderGuess,
+		"ties=" + rules.ties,
+		"tokenizer=" + rules.tokenizer,
+		"minLength=" + strconv.Itoa(rules.minLength),
+		"minCount=" + strconv.Itoa(rules.minCount),
+		"maxCount=" + strconv.Itoa(rules.maxCount),
+		"stopWords=" + stopWords,
+		"picker=" + rules.picker,
+		"seed=" + strconv.FormatInt(rules.seed, 10),
+		"words=" + strconv.Itoa(rules.words),
+	}
+}
+
+// Tokenizer returns the tokenizer the rules choose
+func (rules gameRules) Tokenizer() Tokenizer {
+	return tokenizers[rules.tokenizer]
+}
+
+func (rules gameRules) isDefault() bool {
+	return rules == defaultRules()
+}
+
+// fields returns the rules as JSON message fields.
+func (rules gameRules) fields() map[string]interface{} {
+	return map[string]interface{}{
+		"min":         rules.minPlayers,
+		"max":         rules.maxPlayers,
+		"rounds":      rules.rounds,
+		"timeout":     int(rules.guessTimeout / time.Second),
+		"pickTimeout": int(rules.pickTimeout / time.Second),
+		"leaderGuess": rules.leaderGuess,
+		"ties":        rules.ties,
+		"tokenizer":   rules.tokenizer,
+		"minLength":   rules.minLength,
+		"minCount":    rules.minCount,
+		"maxCount":    rules.maxCount,
+		"stopWords":   rules.stopWords,
+		"picker":      rules.picker,
+		"seed":        rules.seed,
+		"words":       rules.words,
+	}
+}
+
+// String describes the rules to text clients.
+func (rules gameRules) String() string {
+	desc := []string{fmt.Sprintf("%d-%d players", rules.minPlayers, rules.maxPlayers)}
+	if rules.rounds == 1 {
+		desc = append(desc, "1 round")
+	} else if rules.rounds > 1 {
+		desc = append(desc, fmt.Sprintf("%d rounds", rules.rounds))
+	}
+	if rules.pickTimeout > 0 {
+		desc = append(desc, fmt.Sprintf("%ds to pick", int(rules.pickTimeout/time.Second)))
+	}
+	if rules.guessTimeout > 0 {
+		desc = append(desc, fmt.Sprintf("%ds to guess", int(rules.guessTimeout/time.Second)))
+	}
+	if !rules.leaderGuess {
+		desc = append(desc, "the leader does not guess")
+	}
+	if rules.ties == TIES_SHARED {
+		desc = append(desc, "ties are shared")
+	}
+	if rules.tokenizer != TOKENS_WHITESPACE {
+		desc = append(desc, "words are counted by the "+rules.tokenizer+" tokenizer")
+	}
+	if rules.minLength > 0 {
+		desc = append(desc, fmt.Sprintf("picked words have at least %d letters", rules.minLength))
+	}
+	if rules.minCount > 0 || rules.maxCount > 0 {
+		band := fmt.Sprintf("at least %d times", rules.minCount)
+		if rules.maxCount > 0 {
+			band = fmt.Sprintf("%d to %d times", rules.minCount, rules.maxCount)
+		}
+		desc = append(desc, "picked words occur "+band)
+	}
+	if rules.stopWords == STOP_WORDS_ENGLISH {
+		desc = append(desc, "common English words may not be picked")
+	} else if rules.stopWords != "" {
+		desc = append(desc, "the words "+strings.ReplaceAll(rules.stopWords, ",", ", ")+" may not be picked")
+	}
+	if rules.picker == PICKER_SERVER {
+		desc = append(desc, "the server picks the word")
+	}
+	if rules.seed != 0 {
+		desc = append(desc, fmt.Sprintf("seed %d", rules.seed))
+	}
+	if rules.words > 1 {
+		desc = append(desc, fmt.Sprintf("%d words a round", rules.words))
+	}
+	return strings.Join(desc, ", ")
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	MAX_POINTS  int = 10 // points for a guess that is off by less than one count
+	EXACT_BONUS int = 5  // extra points for guessing the count exactly
+)
+
+// points rewards a guess by its closeness to the actual count: MAX_POINTS
+// scaled down by the relative error, nothing once the guess is off by the
+// actual count or more, and EXACT_BONUS on top for an exact hit.
+func points(guess int, actual int) int {
+	diff := guess - actual
+	if diff < 0 {
+		diff = -diff
+	}
+	if diff == 0 {
+		return MAX_POINTS + EXACT_BONUS
+	}
+	if actual <= 0 || diff >= actual {
+		return 0
+	}
+	return MAX_POINTS * (actual - diff) / actual
+}
+
+// scoreRound adds the points of this round's guesses to the cumulative
+// scores and returns the points of the round. Every target word is scored
+// on its own and the points are added up. Players without a guess score
+// nothing but still show up in the standings.
+func (game *Game) scoreRound(actual []int) map[string]int {
+	round := make(map[string]int)
+	for name := range game.names {
+		round[name] = 0
+	}
+	for name := range game.namesDisconn {
+		round[name] = 0
+	}
+	for name, guess := range game.guessResults {
+		for i, count := range actual {
+			if i < len(guess) {
+				round[name] += points(guess[i], count)
+			}
+		}
+	}
+	for name, p := range round {
+		game.scores[name] += p
+	}
+	return round
+}
+
+// standing is one line of a scoreboard
+type standing struct {
+	name  string
+	score int
+}
+
+// sortScores orders scores from best to worst, ties by name
+func sortScores(scores map[string]int) []standing {
+	standings := make([]standing, 0, len(scores))
+	for name, score := range scores {
+		standings = append(standings, standing{name, score})
+	}
+	sort.Slice(standings, func(i, j int) bool {
+		if standings[i].score != standings[j].score {
+			return standings[i].score > standings[j].score
+		}
+		return standings[i].name < standings[j].name
+	})
+	return standings
+}
+
+// formatScores encodes scores for a mailbox message as "name:score,...",
+// best first.
+func formatScores(scores map[string]int) string {
+	entries := make([]string, 0, len(scores))
+	for _, s := range sortScores(scores) {
+		entries = append(entries, s.name+":"+strconv.Itoa(s.score))
+	}
+	return strings.Join(entries, ",")
+}
+
+// formatDistances encodes the distances of the guesses like formatScores,
+// closest first. parseScores decodes them.
+func formatDistances(distances map[string]int) string {
+	standings := make([]standing, 0, len(distances))
+	for name, distance := range distances {
+		standings = append(standings, standing{name, distance})
+	}
+	sort.Slice(standings, func(i, j int) bool {
+		if standings[i].score != standings[j].score {
+			return standings[i].score < standings[j].score
+		}
+		return standings[i].name < standings[j].name
+	})
+	entries := make([]string, 0, len(standings))
+	for _, s := range standings {
+		entries = append(entries, s.name+":"+strconv.Itoa(s.score))
+	}
+	return strings.Join(entries, ",")
+}
+
+// formatGuess encodes a guess, a count per target word, as "3,12"
+func formatGuess(guess []int) string {
+	entries := make([]string, len(guess))
+	for i, count := range guess {
+		entries[i] = strconv.Itoa(count)
+	}
+	return strings.Join(entries, ",")
+}
+
+// parseGuess decodes the output of formatGuess
+func parseGuess(encoded string) ([]int, error) {
+	guess := make([]int, 0)
+	for _, entry := range strings.Split(encoded, ",") {
+		count, err := strconv.Atoi(entry)
+		if err != nil {
+			return nil, err
+		}
+		guess = append(guess, count)
+	}
+	return guess, nil
+}
+
+// parseScores decodes the output of formatScores
+func parseScores(encoded string) []standing {
+	standings := make([]standing, 0)
+	for _, entry := range strings.Split(encoded, ",") {
+		i := strings.LastIndex(entry, ":")
+		if i < 0 {
+			continue
+		}
+		score, _ := strconv.Atoi(entry[i+1:])
+		standings = append(standings, standing{entry[:i], score})
+	}
+	return standings
+}
+
+// splitNames decodes a comma separated list of names
+func splitNames(encoded string) []string {
+	if encoded == "" {
+		return []string{}
+	}
+	return strings.Split(encoded, ",")
+}
+
+// describeScores renders standings for text clients, e.g. "alice 25, bob 10"
+func describeScores(standings []standing) string {
+	entries := make([]string, 0, len(standings))
+	for _, s := range standings {
+		entries = append(entries, fmt.Sprintf("%s %d", s.name, s.score))
+	}
+	return strings.Join(entries, ", ")
+}
+
+// scoreFields renders standings for JSON clients
+func scoreFields(standings []standing) []map[string]interface{} {
+	fields := make([]map[string]interface{}, 0, len(standings))
+	for _, s := range standings {
+		fields = append(fields, map[string]interface{}{"name": s.name, "score": s.score})
+	}
+	return fields
+}
+
+// distanceFields renders the distances of the guesses for JSON clients
+func distanceFields(distances []standing) []map[string]interface{} {
+	fields := make([]map[string]interface{}, 0, len(distances))
+	for _, d := range distances {
+		fields = append(fields, map[string]interface{}{"name": d.name, "distance": d.score})
+	}
+	return fields
+}
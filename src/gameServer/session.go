@@ -0,0 +1,124 @@
+package main
+
+import (
+	"time"
+)
+
+// Every HELLO opens a session, and the WELCOME carries its token. A client
+// that loses its connection starts the next one with RESUME <token>
+// instead of HELLO and gets its player back, whatever the name. A session
+// lasts while the player is online and for the session timeout after it
+// disconnects; a player that stays away longer loses its seats, see
+// Game.expire, and has to start over with HELLO. Every HELLO and RESUME
+// replaces the token of the player.
+//
+// Sessions live in the server routine and do not survive a restart of the
+// server, the players of recovered games come back with HELLO.
+
+// session is what a token stands for
+type session struct {
+	name    string
+	offline time.Time // when the player disconnected, zero while online
+}
+
+// SetSessionTimeout sets how long a disconnected player keeps its session
+// and its seats, 0 for ever. It is called before Run.
+func (server *GameServer) SetSessionTimeout(timeout time.Duration) {
+	server.sessionTimeout = timeout
+}
+
+// expired tells whether a session ran out
+func (server *GameServer) expired(s *session) bool {
+	return server.sessionTimeout > 0 && !s.offline.IsZero() && time.Since(s.offline) >= server.sessionTimeout
+}
+
+// openSession returns a new token for a player, its older tokens and any
+// expired ones stop working
+func (server *GameServer) openSession(name string) string {
+	for token, s := range server.sessions {
+		if s.name == name || server.expired(s) {
+			delete(server.sessions, token)
+		}
+	}
+	token := randomHex(16)
+	server.sessions[token] = &session{name: name}
+	return token
+}
+
+// resumeSession returns the name a token stands for, or "" if the token is
+// unknown or expired
+func (server *GameServer) resumeSession(token string) string {
+	s, ok := server.sessions[token]
+	if !ok || server.expired(s) {
+		delete(server.sessions, token)
+		return ""
+	}
+	return s.name
+}
+
+// sessionOnline starts or stops the clock of the session of a player
+func (server *GameServer) sessionOnline(name string, online bool) {
+	for _, s := range server.sessions {
+		if s.name != name {
+			continue
+		}
+		s.offline = time.Time{}
+		if !online {
+			s.offline = time.Now()
+		}
+	}
+}
+
+// armExpiry releases the seat of a disconnected player once its session
+// runs out, unless it is back by then
+func (game *Game) armExpiry(name string) {
+	timeout := game.server.sessionTimeout
+	if timeout <= 0 {
+		return
+	}
+	game.disconnSince[name] = time.Now()
+	go func() {
+		time.Sleep(timeout)
+		select {
+		case game.expired <- name:
+		case <-game.done:
+		}
+	}()
+}
+
+// expire releases the seat of a player that stayed away for the session
+// timeout and tells the others. It returns whether the game is closed
+// because nobody is left.
+func (game *Game) expire(name string) bool {
+	since, ok := game.disconnSince[name]
+	if _, away := game.namesDisconn[name]; !away || !ok || time.Since(since) < game.server.sessionTimeout {
+		// back in the meantime, or gone again later
+		return false
+	}
+	game.record("leave", map[string]string{"name": name})
+	delete(game.namesDisconn, name)
+	delete(game.disconnSince, name)
+	delete(game.chatBacklog, name)
+	if len(game.names)+len(game.namesDisconn) == 0 {
+		game.record("close", nil)
+		game.cleanup(false)
+		game.notifySpectators(map[string]string{"gameID": game.gameID, "msg": "CLOSED"})
+		return true
+	}
+	notification := map[string]string{"gameID": game.gameID, "msg": "EXPIRED", "name": name}
+	for _, box := range game.names {
+		box <- notification
+	}
+	game.notifySpectators(notification)
+	if game.state != RUNNING {
+		game.changeState()
+		game.promoteSpectators()
+	} else if name == game.picker && game.tgtWords == nil {
+		// the picker never came back, choose a new picker
+		game.picker = game.choosePicker(name)
+		game.record("picker", map[string]string{"name": game.picker})
+		game.notifyPicker()
+		game.armPickDeadline()
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// A Tokenizer splits a line of an uploaded file into the words that are
+// counted in wordDict. The picked word goes through the same tokenizer, so
+// with the fold tokenizer picking "Word" selects the count of "word".
+type Tokenizer interface {
+	Tokens(line string) []string
+}
+
+// tokenizerFunc turns a plain function into a Tokenizer
+type tokenizerFunc func(line string) []string
+
+func (f tokenizerFunc) Tokens(line string) []string {
+	return f(line)
+}
+
+// tokenizer strategies, chosen with the "tokenizer" rule at NEW_GAME
+const (
+	TOKENS_WHITESPACE string = "whitespace" // words are separated by spaces and tabs, as they are written
+	TOKENS_WORDS      string = "words"      // words are runs of letters and digits, punctuation separates them
+	TOKENS_FOLD       string = "fold"       // like words, in lower case
+	TOKENS_STRIP      string = "strip"      // like whitespace, without punctuation around the words
+	TOKENS_STEM       string = "stem"       // like fold, reduced to their stems
+)
+
+var tokenizers = map[string]Tokenizer{
+	TOKENS_WHITESPACE: tokenizerFunc(strings.Fields),
+	TOKENS_WORDS:      tokenizerFunc(unicodeWords),
+	TOKENS_FOLD:       tokenizerFunc(foldedWords),
+	TOKENS_STRIP:      tokenizerFunc(strippedWords),
+	TOKENS_STEM:       tokenizerFunc(stemmedWords),
+}
+
+// unicodeWords splits a line at everything that is not a letter, a digit or
+// a mark. An apostrophe or hyphen between two letters stays in the word, so
+// "don't" and "well-known" are single words.
+func unicodeWords(line string) []string {
+	inWord := func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r)
+	}
+	runes := []rune(line)
+	words := make([]string, 0)
+	start := -1
+	for i, r := range runes {
+		joiner := (r == '\'' || r == '’' || r == '-') && start >= 0 &&
+			i+1 < len(runes) && unicode.IsLetter(runes[i-1]) && unicode.IsLetter(runes[i+1])
+		if inWord(r) || joiner {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			words = append(words, string(runes[start:i]))
+			start = -1
+		}
+	}
+	if start >= 0 {
+		words = append(words, string(runes[start:]))
+	}
+	return words
+}
+
+func foldedWords(line string) []string {
+	words := unicodeWords(line)
+	for i, word := range words {
+		words[i] = strings.ToLower(word)
+	}
+	return words
+}
+
+func strippedWords(line string) []string {
+	trim := func(r rune) bool {
+		return unicode.IsPunct(r) || unicode.IsSymbol(r)
+	}
+	words := make([]string, 0)
+	for _, word := range strings.Fields(line) {
+		if word = strings.TrimFunc(word, trim); word != "" {
+			words = append(words, word)
+		}
+	}
+	return words
+}
+
+func stemmedWords(line string) []string {
+	words := foldedWords(line)
+	for i, word := range words {
+		words[i] = stem(word)
+	}
+	return words
+}
+
+// stem strips the common English inflections from a lower case word, e.g.
+// "counting", "counted" and "counts" all become "count". It is a light
+// stemmer: irregular forms are left alone and short words are not touched.
+func stem(word string) string {
+	hasVowel := func(s string) bool {
+		return strings.ContainsAny(s, "aeiouy")
+	}
+	switch {
+	case len(word) <= 3:
+		return word
+	case strings.HasSuffix(word, "sses"):
+		return strings.TrimSuffix(word, "es")
+	case strings.HasSuffix(word, "ies") && len(word) > 4:
+		return strings.TrimSuffix(word, "ies") + "y"
+	case strings.HasSuffix(word, "ss"), strings.HasSuffix(word, "us"), strings.HasSuffix(word, "is"):
+		return word
+	case strings.HasSuffix(word, "s"):
+		return strings.TrimSuffix(word, "s")
+	}
+	for _, suffix := range []string{"ingly", "edly", "ing", "ed", "ly"} {
+		base := strings.TrimSuffix(word, suffix)
+		if base == word || len(base) < 3 || !hasVowel(base) {
+			continue
+		}
+		// running -> run, hopped -> hop
+		if n := len(base); base[n-1] == base[n-2] && !strings.ContainsAny(base[n-1:], "lsz") && !hasVowel(base[n-1:]) {
+			base = base[:n-1]
+		}
+		return base
+	}
+	return word
+}
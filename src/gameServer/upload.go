@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// An upload session lets the leader send a large file in chunks:
+//
+//	UPLOAD_BEGIN <gameID> <filename> <size> [sha256=<hex>] [format=<format>] [columns=<list>] [save=<name>]
+//	UPLOAD_CHUNK <gameID> <offset> <length> <data>\n
+//	UPLOAD_COMMIT <gameID>
+//
+// Chunks are appended to a temp file in the game directory, so a session
+// outlives the leader's connection and, through the journal, the server.
+// Nobody is told about the file before it is committed.
+type uploadSession struct {
+	fileName string
+	size     int
+	checksum string // expected sha256 of the file, "" if not given
+	received int    // bytes written so far, the offset of the next chunk
+	format   string // format of the file, "" to go by its extension, see formats.go
+	columns  string // CSV columns to count
+	save     string // name to save the file under in the corpus library, see library.go
+}
+
+// UploadTempPrefix is prepended to the file name of an upload in progress
+const UploadTempPrefix string = ".upload-"
+
+func (game *Game) uploadPath() string {
+	return game.directory + UploadTempPrefix + game.upload.fileName
+}
+
+// validFileName rejects names that would leave the game directory or clash
+// with the journal and temp files
+func validFileName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, "/\\")
+}
+
+// beginUpload starts a session, or resumes the current one if it is for
+// the same file
+func (game *Game) beginUpload(session uploadSession) map[string]string {
+	if _, err := os.Stat(game.directory + session.fileName); err == nil {
+		return map[string]string{"status": "fail", "reason": "file exists", "filename": session.fileName}
+	}
+	if game.upload != nil && game.upload.fileName == session.fileName && game.upload.size == session.size &&
+		game.upload.checksum == session.checksum {
+		// the format may still change
+		game.upload.format, game.upload.columns, game.upload.save = session.format, session.columns, session.save
+		return game.uploadResponse()
+	}
+	if game.upload != nil {
+		// a different file replaces the unfinished one
+		os.Remove(game.uploadPath())
+	}
+	game.record("upload_begin", map[string]string{"filename": session.fileName, "size": strconv.Itoa(session.size),
+		"sha256": session.checksum, "format": session.format, "columns": session.columns, "save": session.save})
+	session.received = 0
+	game.upload = &session
+	fd, err := os.Create(game.uploadPath())
+	if err != nil {
+		game.upload = nil
+		return map[string]string{"status": "fail", "reason": "write failed"}
+	}
+	fd.Close()
+	return game.uploadResponse()
+}
+
+// writeChunk appends a chunk that starts where the previous one ended
+func (game *Game) writeChunk(offset string, data string) map[string]string {
+	if game.upload == nil {
+		return map[string]string{"status": "fail", "reason": "no upload"}
+	}
+	if offset != strconv.Itoa(game.upload.received) {
+		response := game.uploadResponse()
+		response["status"], response["reason"] = "fail", "bad offset"
+		return response
+	}
+	if game.upload.received+len(data) > game.upload.size {
+		response := game.uploadResponse()
+		response["status"], response["reason"] = "fail", "too long"
+		return response
+	}
+	fd, err := os.OpenFile(game.uploadPath(), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return map[string]string{"status": "fail", "reason": "write failed"}
+	}
+	n, err := io.WriteString(fd, data)
+	fd.Close()
+	game.upload.received += n
+	if err != nil {
+		return map[string]string{"status": "fail", "reason": "write failed"}
+	}
+	return game.uploadResponse()
+}
+
+// commitUpload moves a complete upload in place. A file that does not
+// match its checksum is dropped and has to be uploaded again.
+func (game *Game) commitUpload() map[string]string {
+	if game.upload == nil {
+		return map[string]string{"status": "fail", "reason": "no upload"}
+	}
+	if game.upload.received < game.upload.size {
+		response := game.uploadResponse()
+		response["status"], response["reason"] = "fail", "incomplete"
+		return response
+	}
+	if game.upload.checksum != "" {
+		fd, err := os.Open(game.uploadPath())
+		if err != nil {
+			return map[string]string{"status": "fail", "reason": "write failed"}
+		}
+		hash := sha256.New()
+		io.Copy(hash, fd)
+		fd.Close()
+		if !strings.EqualFold(hex.EncodeToString(hash.Sum(nil)), game.upload.checksum) {
+			os.Remove(game.uploadPath())
+			game.upload = nil
+			return map[string]string{"status": "fail", "reason": "checksum mismatch"}
+		}
+	}
+	session := game.upload
+	if err := os.Rename(game.uploadPath(), game.directory+session.fileName); err != nil {
+		return map[string]string{"status": "fail", "reason": "write failed"}
+	}
+	game.upload = nil
+	return map[string]string{"status": "success", "filename": session.fileName,
+		"format": session.format, "columns": session.columns, "save": session.save}
+}
+
+func (game *Game) uploadResponse() map[string]string {
+	return map[string]string{
+		"status":   "success",
+		"filename": game.upload.fileName,
+		"offset":   strconv.Itoa(game.upload.received),
+		"size":     strconv.Itoa(game.upload.size),
+	}
+}
+
+// resumeUpload restores a session from the journal, the temp file tells
+// how much of it had been received
+func (game *Game) resumeUpload(entry map[string]string) {
+	size, _ := strconv.Atoi(entry["size"])
+	game.upload = &uploadSession{fileName: entry["filename"], size: size, checksum: entry["sha256"],
+		format: entry["format"], columns: entry["columns"], save: entry["save"]}
+	info, err := os.Stat(game.uploadPath())
+	if err != nil {
+		// dropped after a checksum mismatch
+		game.upload = nil
+		return
+	}
+	game.upload.received = int(info.Size())
+}